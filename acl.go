@@ -0,0 +1,182 @@
+package pfilter
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+)
+
+// ACLRule allows or denies packets from the addresses of a network.
+type ACLRule struct {
+	Prefix netip.Prefix
+	Deny   bool
+}
+
+// ACL decides whether packets from a remote address are allowed, using the
+// rule with the longest prefix matching the address. ACLs are immutable, and
+// are replaced as a whole to change the rules.
+type ACL struct {
+	defaultAllow bool
+	v4           *aclNode
+	v6           *aclNode
+}
+
+// aclNode is a node of a binary trie over address bits.
+type aclNode struct {
+	children [2]*aclNode
+	// Set if a rule ends at this node.
+	rule *ACLRule
+}
+
+// NewACL builds an ACL from the given rules. Addresses which do not match any
+// rule are allowed if defaultAllow is set. IPv4-mapped IPv6 prefixes are
+// treated as IPv4 prefixes. Of rules with the same prefix, the last one wins.
+func NewACL(defaultAllow bool, rules ...ACLRule) (*ACL, error) {
+	acl := &ACL{
+		defaultAllow: defaultAllow,
+		v4:           &aclNode{},
+		v6:           &aclNode{},
+	}
+	for i := range rules {
+		rule := rules[i]
+		if !rule.Prefix.IsValid() {
+			return nil, errors.New("invalid acl prefix")
+		}
+		addr, bits := rule.Prefix.Addr(), rule.Prefix.Bits()
+		if addr.Is4In6() && bits >= 96 {
+			addr, bits = addr.Unmap(), bits-96
+		}
+		rule.Prefix = netip.PrefixFrom(addr, bits).Masked()
+
+		node := acl.root(addr)
+		raw := addr.AsSlice()
+		for bit := 0; bit < bits; bit++ {
+			next := &node.children[addrBit(raw, bit)]
+			if *next == nil {
+				*next = &aclNode{}
+			}
+			node = *next
+		}
+		node.rule = &rule
+	}
+	return acl, nil
+}
+
+// Allowed returns whether packets from the given address are allowed.
+func (a *ACL) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() {
+		return a.defaultAllow
+	}
+
+	var match *ACLRule
+	node := a.root(addr)
+	raw := addr.AsSlice()
+	for bit := 0; node != nil; bit++ {
+		if node.rule != nil {
+			match = node.rule
+		}
+		if bit == len(raw)*8 {
+			break
+		}
+		node = node.children[addrBit(raw, bit)]
+	}
+	if match == nil {
+		return a.defaultAllow
+	}
+	return !match.Deny
+}
+
+// allowedAddr is Allowed for the remote address of a packet. Addresses without
+// an IP are subject to the default.
+func (a *ACL) allowedAddr(addr net.Addr) bool {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return a.defaultAllow
+	}
+	return a.Allowed(ip)
+}
+
+func (a *ACL) root(addr netip.Addr) *aclNode {
+	if addr.Is4() {
+		return a.v4
+	}
+	return a.v6
+}
+
+func addrBit(raw []byte, bit int) int {
+	return int(raw[bit/8]>>(7-bit%8)) & 1
+}
+
+// aclBox allows storing nil ACLs in an atomic.Value.
+type aclBox struct {
+	*ACL
+}
+
+var _ ContextFilter = (*ACLFilter)(nil)
+
+// ACLFilter is a Filter restricting the remote addresses a connection receives
+// packets from. Packets from allowed addresses are passed on to the next
+// filter, or claimed if there is none, packets from denied addresses are
+// left for other connections. The ACL can be replaced at runtime.
+type ACLFilter struct {
+	// Holds an aclBox.
+	acl  atomic.Value
+	next Filter
+}
+
+// NewACLFilter returns a filter using the given ACL, passing packets from
+// allowed addresses on to next, which may be nil.
+func NewACLFilter(acl *ACL, next Filter) *ACLFilter {
+	f := &ACLFilter{next: next}
+	f.SetACL(acl)
+	return f
+}
+
+// SetACL atomically replaces the ACL. A nil ACL allows all addresses.
+func (f *ACLFilter) SetACL(acl *ACL) {
+	f.acl.Store(aclBox{acl})
+}
+
+// ACL returns the ACL currently in use.
+func (f *ACLFilter) ACL() *ACL {
+	return f.acl.Load().(aclBox).ACL
+}
+
+// Outgoing passes outgoing packets on to the next filter.
+func (f *ACLFilter) Outgoing(b []byte, addr net.Addr) {
+	if f.next != nil {
+		f.next.Outgoing(b, addr)
+	}
+}
+
+// ClaimIncoming implements Filter.
+func (f *ACLFilter) ClaimIncoming(b []byte, addr net.Addr) bool {
+	return f.Verdict(b, addr) == VerdictClaim
+}
+
+// Verdict implements VerdictFilter.
+func (f *ACLFilter) Verdict(b []byte, addr net.Addr) Verdict {
+	return f.Inspect(&Packet{Data: b, Addr: addr})
+}
+
+// Inspect implements ContextFilter.
+func (f *ACLFilter) Inspect(p *Packet) Verdict {
+	if acl := f.ACL(); acl != nil && !acl.allowedAddr(p.Addr) {
+		return VerdictPass
+	}
+	switch next := f.next.(type) {
+	case nil:
+		return VerdictClaim
+	case ContextFilter:
+		return next.Inspect(p)
+	case VerdictFilter:
+		return next.Verdict(p.Data, p.Addr)
+	default:
+		if next.ClaimIncoming(p.Data, p.Addr) {
+			return VerdictClaim
+		}
+		return VerdictPass
+	}
+}
@@ -0,0 +1,107 @@
+package pfilter
+
+import (
+	"sort"
+)
+
+// defaultOOBBufferSize fits the control messages of interest: packet info,
+// TOS/traffic class, hop limit and timestamps, for both IPv4 and IPv6 as dual
+// stack sockets might report both.
+const defaultOOBBufferSize = 256
+
+// Allocator provides the buffers packets are read into, and buffers for copies
+// of packets. Implementations must be safe for concurrent use.
+type Allocator interface {
+	// Get returns a buffer of the given length.
+	Get(size int) []byte
+	// Put returns a buffer obtained from Get once it is no longer used.
+	Put(buf []byte)
+}
+
+// NewSizeClassAllocator returns an allocator keeping a free list of buffers
+// for each of the given sizes, holding at most perClass buffers each. Buffers
+// are served from the smallest class that fits the requested size, and
+// allocated directly if larger than all classes. Neither Get nor Put allocate
+// while the free lists are warm.
+func NewSizeClassAllocator(perClass int, sizes ...int) Allocator {
+	sizes = append([]int(nil), sizes...)
+	sort.Ints(sizes)
+
+	a := &sizeClassAllocator{}
+	for _, size := range sizes {
+		if size < 1 || (len(a.classes) > 0 && a.classes[len(a.classes)-1].size == size) {
+			continue
+		}
+		a.classes = append(a.classes, newBufferPool(size, perClass))
+	}
+	return a
+}
+
+type sizeClassAllocator struct {
+	// Sorted by size.
+	classes []*bufferPool
+}
+
+func (a *sizeClassAllocator) Get(size int) []byte {
+	for _, class := range a.classes {
+		if class.size >= size {
+			return class.get()[:size]
+		}
+	}
+	return make([]byte, size)
+}
+
+func (a *sizeClassAllocator) Put(buf []byte) {
+	// Buffers not handed out by us do not match a class exactly, and are left
+	// to the garbage collector.
+	for _, class := range a.classes {
+		if class.size == cap(buf) {
+			class.put(buf)
+			return
+		}
+	}
+}
+
+// defaultSizeClasses returns the sizes used by the default allocator: the
+// control buffer size, powers of two to right-size small packets into, and the
+// read buffer size.
+func defaultSizeClasses(bufferSize, oobSize int) []int {
+	sizes := []int{oobSize, bufferSize}
+	for size := 64; size < bufferSize; size *= 2 {
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+// bufferPool is a bounded free list of equally sized buffers. Unlike
+// sync.Pool, returning a slice to it does not allocate, which keeps buffer
+// management on the steady-state receive path allocation free.
+type bufferPool struct {
+	size int
+	free chan []byte
+}
+
+func newBufferPool(size, capacity int) *bufferPool {
+	return &bufferPool{
+		size: size,
+		free: make(chan []byte, capacity),
+	}
+}
+
+func (p *bufferPool) get() []byte {
+	select {
+	case buf := <-p.free:
+		return buf
+	default:
+		return make([]byte, p.size)
+	}
+}
+
+// put returns the buffer to the pool, or leaves it to the garbage collector if
+// the pool is full.
+func (p *bufferPool) put(buf []byte) {
+	select {
+	case p.free <- buf[:p.size]:
+	default:
+	}
+}
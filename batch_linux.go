@@ -0,0 +1,160 @@
+package pfilter
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is struct mmsghdr of recvmmsg(2). Go pads it the same way C does.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// mmsgReader reads batches with recvmmsg(2) like ipv4.PacketConn.ReadBatch,
+// but keeps the remote address of each message slot while the sender stays
+// the same, so that steady-state reads do not allocate.
+type mmsgReader struct {
+	raw   syscall.RawConn
+	hdrs  []mmsghdr
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrInet6
+	// Remote addresses of the slots, as last read, to tell whether the
+	// *net.UDPAddr of the slot can be reused.
+	senders []netip.AddrPort
+	scopes  []uint32
+
+	// Arguments and results of the read function, which is created once as
+	// creating it on every read would allocate.
+	vlen  int
+	flags int
+	n     int
+	errno syscall.Errno
+	read  func(fd uintptr) bool
+}
+
+// newBatchReader returns a reader of batches from conn, falling back to pconn.
+func newBatchReader(conn *net.UDPConn, pconn *ipv4.PacketConn, size int) batchReader {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return pconn
+	}
+	r := &mmsgReader{
+		raw:     raw,
+		hdrs:    make([]mmsghdr, size),
+		iovs:    make([]unix.Iovec, size),
+		names:   make([]unix.RawSockaddrInet6, size),
+		senders: make([]netip.AddrPort, size),
+		scopes:  make([]uint32, size),
+	}
+	for i := range r.hdrs {
+		r.hdrs[i].hdr.Iov = &r.iovs[i]
+		r.hdrs[i].hdr.SetIovlen(1)
+		r.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+	}
+	r.read = r.recvmmsg
+	return r
+}
+
+func (r *mmsgReader) recvmmsg(fd uintptr) bool {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&r.hdrs[0])),
+			uintptr(r.vlen), uintptr(r.flags), 0, 0)
+		switch errno {
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return false
+		}
+		r.n, r.errno = int(n), errno
+		return true
+	}
+}
+
+// ReadBatch reads into the first buffer of each message, and sets the remote
+// address of the message to the one of the previous message read into the
+// same slot if the sender is the same.
+func (r *mmsgReader) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	if len(ms) > len(r.hdrs) {
+		ms = ms[:len(r.hdrs)]
+	}
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	for i := range ms {
+		hdr := &r.hdrs[i].hdr
+		r.iovs[i].Base = nil
+		if buf := ms[i].Buffers[0]; len(buf) > 0 {
+			r.iovs[i].Base = &buf[0]
+		}
+		r.iovs[i].SetLen(len(ms[i].Buffers[0]))
+		hdr.Namelen = uint32(unsafe.Sizeof(r.names[i]))
+		hdr.Control = nil
+		if len(ms[i].OOB) > 0 {
+			hdr.Control = &ms[i].OOB[0]
+		}
+		hdr.SetControllen(len(ms[i].OOB))
+		hdr.Flags = 0
+	}
+	r.vlen, r.flags = len(ms), flags
+
+	if err := r.raw.Read(r.read); err != nil {
+		return 0, err
+	}
+	if r.errno != 0 {
+		return 0, &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvmmsg", r.errno)}
+	}
+	for i := 0; i < r.n; i++ {
+		ms[i].N = int(r.hdrs[i].len)
+		ms[i].NN = int(r.hdrs[i].hdr.Controllen)
+		ms[i].Flags = int(r.hdrs[i].hdr.Flags)
+		ms[i].Addr = r.addr(i, ms[i].Addr)
+	}
+	return r.n, nil
+}
+
+// addr returns the remote address read into the given slot, reusing prev if
+// it is that of the same sender.
+func (r *mmsgReader) addr(i int, prev net.Addr) net.Addr {
+	name := &r.names[i]
+	var sender netip.AddrPort
+	var scope uint32
+	switch name.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		sender = netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), networkPort(sa.Port))
+	case unix.AF_INET6:
+		sender = netip.AddrPortFrom(netip.AddrFrom16(name.Addr), networkPort(name.Port))
+		scope = name.Scope_id
+	default:
+		return nil
+	}
+
+	if prev != nil && sender == r.senders[i] && scope == r.scopes[i] {
+		return prev
+	}
+	r.senders[i], r.scopes[i] = sender, scope
+
+	addr := net.UDPAddrFromAddrPort(sender)
+	if scope != 0 {
+		if ifi, err := net.InterfaceByIndex(int(scope)); err == nil {
+			addr.Zone = ifi.Name
+		} else {
+			addr.Zone = strconv.Itoa(int(scope))
+		}
+	}
+	return addr
+}
+
+// networkPort converts a port in network byte order.
+func networkPort(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package pfilter
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// newBatchReader returns a reader of batches from conn.
+func newBatchReader(_ *net.UDPConn, pconn *ipv4.PacketConn, _ int) batchReader {
+	return pconn
+}
@@ -1,8 +1,11 @@
 package pfilter
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -10,18 +13,93 @@ import (
 	"golang.org/x/net/ipv4"
 )
 
+// Conn is implemented by all connections returned by PacketFilter.NewConn.
+type Conn interface {
+	net.PacketConn
+
+	// Stats returns a snapshot of the connection's counters.
+	Stats() ConnStats
+
+	// SetPriority changes the priority of the connection, keeping its
+	// position relative to other connections of the same priority.
+	SetPriority(priority int) error
+	// SetFilter replaces the filter of the connection. Packets already queued
+	// for the connection are kept.
+	SetFilter(filter Filter) error
+
+	// AddKey registers the connection for packets with the given key, as
+	// extracted by Config.KeyFunc. Fails if another connection owns the key.
+	AddKey(key string) error
+	// RemoveKey unregisters the connection from the given key.
+	RemoveKey(key string) error
+
+	// ReadFromControl is like ReadFrom, but also returns the metadata of the
+	// packet enabled via Config.Control, or nil if none was received.
+	ReadFromControl(b []byte) (n int, cm *ControlMessage, addr net.Addr, err error)
+	// ReadBatch reads up to len(ms) queued packets, like
+	// ipv4.PacketConn.ReadBatch, blocking until at least one is available.
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+
+	// ReadFromContext is like ReadFrom, but returns the context's error if it
+	// is done before a packet arrives.
+	ReadFromContext(ctx context.Context, b []byte) (n int, addr net.Addr, err error)
+	// ReadBatchContext is like ipv4.PacketConn.ReadBatch, but returns the
+	// context's error if it is done before a packet arrives.
+	ReadBatchContext(ctx context.Context, ms []ipv4.Message, flags int) (int, error)
+	// WriteToContext is like WriteTo, but fails if the context is done.
+	WriteToContext(ctx context.Context, b []byte, addr net.Addr) (n int, err error)
+
+	// WriteBatch writes a batch of messages, each consisting of a single
+	// buffer which is passed to the filter, using a single system call where
+	// supported. Returns the number of messages written.
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+	// WriteSegments writes b as consecutive datagrams of segmentSize bytes,
+	// the last one possibly shorter, each of which is passed to the filter.
+	// Uses a single system call per up to 64 segments if Config.GSO is set.
+	WriteSegments(b []byte, segmentSize int, addr net.Addr) (n int, err error)
+}
+
+var _ Conn = (*filteredConn)(nil)
+
 type filteredConn struct {
 	// Alignment
-	deadline atomic.Value
+	stats       connCounters
+	queuedBytes int64
+
+	readDeadline  deadline
+	writeDeadline deadline
 
-	source   *PacketFilter
+	source *PacketFilter
+	name   string
+	// Registration order, breaking ties between equal priorities.
+	seq uint64
+	// Guarded by the source's mutex.
 	priority int
 
-	recvBuffer chan messageWithError
+	recvBuffer   chan messageWithError
+	backlogBytes int
+	policy       OverflowPolicy
+	blockTimeout time.Duration
+	space        chan struct{}
+
+	// Holds a filterBox, as the filter can be swapped at runtime.
+	filter atomic.Value
+
+	// Group the connection is a member of, if any.
+	group *connGroup
+
+	// Set if the connection replies from the destination address of packets.
+	replies *replySources
 
-	filter Filter
+	// Set if the connection is rate limited, only used by the read loop.
+	limiter *rateLimiter
 
-	closed chan struct{}
+	// Both are guarded by the source's mutex.
+	keys  map[string]struct{}
+	keyed bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // LocalAddr returns the local address
@@ -31,13 +109,16 @@ func (r *filteredConn) LocalAddr() net.Addr {
 
 // SetReadDeadline sets a read deadline
 func (r *filteredConn) SetReadDeadline(t time.Time) error {
-	r.deadline.Store(t)
+	r.readDeadline.set(t)
 	return nil
 }
 
-// SetWriteDeadline sets a write deadline
+// SetWriteDeadline sets a write deadline, which only affects this connection.
+// Writes are refused once it passed, but a write already blocked on the
+// underlying connection is not interrupted.
 func (r *filteredConn) SetWriteDeadline(t time.Time) error {
-	return r.source.conn.SetWriteDeadline(t)
+	r.writeDeadline.set(t)
+	return nil
 }
 
 // SetDeadline sets a read and a write deadline
@@ -48,121 +129,363 @@ func (r *filteredConn) SetDeadline(t time.Time) error {
 
 // WriteTo writes bytes to the given address
 func (r *filteredConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
-	select {
-	case <-r.closed:
-		return 0, errClosed
-	default:
+	return r.WriteToContext(context.Background(), b, addr)
+}
+
+// WriteToContext writes bytes to the given address, unless the context is
+// already done. Writes to UDP sockets do not block on the network, so the
+// context is only checked before writing.
+func (r *filteredConn) WriteToContext(ctx context.Context, b []byte, addr net.Addr) (n int, err error) {
+	if err := r.checkWriteState(); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
 	}
 
-	if r.filter != nil {
-		r.filter.Outgoing(b, addr)
+	if filter := r.loadFilter(); filter != nil {
+		filter.Outgoing(b, addr)
+	}
+	n, err = r.writeTo(b, addr)
+	if err == nil {
+		r.stats.written(n)
+	}
+	return n, err
+}
+
+func (r *filteredConn) writeTo(b []byte, addr net.Addr) (int, error) {
+	if r.replies != nil {
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			if oob := r.replies.controlMessage(udpAddr); oob != nil {
+				n, _, err := r.source.oobConn.WriteMsgUDP(b, oob, udpAddr)
+				return n, err
+			}
+		}
 	}
 	return r.source.conn.WriteTo(b, addr)
 }
 
+// WriteBatch writes a batch of messages, using a single system call where
+// supported by the underlying connection. Every message must consist of a
+// single buffer, which is passed to the connection's filter. Returns the number
+// of messages written.
+func (r *filteredConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	if flags != 0 {
+		return 0, errNotSupported
+	}
+
+	if err := r.checkWriteState(); err != nil {
+		return 0, err
+	}
+
+	for i := range ms {
+		if len(ms[i].Buffers) != 1 {
+			return 0, errNotSupported
+		}
+	}
+
+	filter := r.loadFilter()
+	if filter != nil {
+		for i := range ms {
+			filter.Outgoing(ms[i].Buffers[0], ms[i].Addr)
+		}
+	}
+
+	if r.source.ipv4Conn == nil {
+		for i := range ms {
+			if i > 0 && r.writeTimedOut() {
+				return i, errTimeout
+			}
+			n, err := r.writeTo(ms[i].Buffers[0], ms[i].Addr)
+			if err != nil {
+				return i, err
+			}
+			ms[i].N = n
+			r.stats.written(n)
+		}
+		return len(ms), nil
+	}
+
+	if r.replies != nil {
+		// Control messages are only set for the duration of the call, to leave
+		// the caller's messages as they were.
+		var restore []int
+		defer func() {
+			for _, i := range restore {
+				ms[i].OOB = nil
+			}
+		}()
+		for i := range ms {
+			if udpAddr, ok := ms[i].Addr.(*net.UDPAddr); ok && ms[i].OOB == nil {
+				if oob := r.replies.controlMessage(udpAddr); oob != nil {
+					ms[i].OOB = oob
+					restore = append(restore, i)
+				}
+			}
+		}
+	}
+
+	// Platforms without sendmmsg write a single message per call.
+	written := 0
+	for written < len(ms) {
+		if written > 0 && r.writeTimedOut() {
+			return written, errTimeout
+		}
+		n, err := r.source.ipv4Conn.WriteBatch(ms[written:], 0)
+		if n < 0 {
+			n = 0
+		}
+		for _, m := range ms[written : written+n] {
+			r.stats.written(m.N)
+		}
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// maxGSOSegments is the number of segments the kernel accepts per send.
+const maxGSOSegments = 64
+
+// WriteSegments writes b as consecutive datagrams of segmentSize bytes
+func (r *filteredConn) WriteSegments(b []byte, segmentSize int, addr net.Addr) (n int, err error) {
+	if segmentSize < 1 {
+		return 0, errors.New("invalid segment size")
+	}
+
+	if err := r.checkWriteState(); err != nil {
+		return 0, err
+	}
+
+	filter := r.loadFilter()
+	if filter != nil {
+		for offset := 0; offset < len(b); offset += segmentSize {
+			filter.Outgoing(b[offset:segmentEnd(b, offset, segmentSize)], addr)
+		}
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || atomic.LoadInt32(&r.source.gso) == 0 {
+		return r.writeEachSegment(b, 0, segmentSize, addr)
+	}
+
+	var oob []byte
+	if r.replies != nil {
+		oob = r.replies.controlMessage(udpAddr)
+	}
+	oob = appendGSO(oob, segmentSize)
+
+	// The total size of a send is bounded by the maximum datagram size too,
+	// minus the UDP and IPv6 headers.
+	perSend := (maxDatagramSize - 8 - 40) / segmentSize
+	if perSend > maxGSOSegments {
+		perSend = maxGSOSegments
+	}
+	if perSend < 1 {
+		perSend = 1
+	}
+	for n < len(b) {
+		if n > 0 && r.writeTimedOut() {
+			return n, errTimeout
+		}
+		chunk := b[n:segmentEnd(b, n, perSend*segmentSize)]
+		written, _, err := r.source.oobConn.WriteMsgUDP(chunk, oob, udpAddr)
+		if err != nil {
+			if isGSOError(err) {
+				// The kernel supports segmentation, but the device does not,
+				// such as without checksum offload. Stop trying.
+				atomic.StoreInt32(&r.source.gso, 0)
+				return r.writeEachSegment(b, n, segmentSize, addr)
+			}
+			return n, err
+		}
+		if written == 0 {
+			return n, io.ErrShortWrite
+		}
+		for offset := 0; offset < written; offset += segmentSize {
+			r.stats.written(segmentEnd(chunk[:written], offset, segmentSize) - offset)
+		}
+		n += written
+	}
+	return n, nil
+}
+
+// writeEachSegment writes the segments of b following the first n bytes with a
+// system call each.
+func (r *filteredConn) writeEachSegment(b []byte, n, segmentSize int, addr net.Addr) (int, error) {
+	for n < len(b) {
+		if n > 0 && r.writeTimedOut() {
+			return n, errTimeout
+		}
+		written, err := r.writeTo(b[n:segmentEnd(b, n, segmentSize)], addr)
+		if err != nil {
+			return n, err
+		}
+		if written == 0 {
+			return n, io.ErrShortWrite
+		}
+		r.stats.written(written)
+		n += written
+	}
+	return n, nil
+}
+
+// segmentEnd returns the end of the segment of b starting at offset.
+func segmentEnd(b []byte, offset, segmentSize int) int {
+	if end := offset + segmentSize; end < len(b) {
+		return end
+	}
+	return len(b)
+}
+
 // ReadFrom reads from the filtered connection
 func (r *filteredConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
-	select {
-	case <-r.closed:
-		return 0, nil, errClosed
-	default:
-	}
+	n, _, addr, err = r.readFrom(context.Background(), b, false)
+	return n, addr, err
+}
 
-	var timeout <-chan time.Time
+// ReadFromContext reads from the filtered connection, returning the context's
+// error if it is done before a packet arrives
+func (r *filteredConn) ReadFromContext(ctx context.Context, b []byte) (n int, addr net.Addr, err error) {
+	n, _, addr, err = r.readFrom(ctx, b, false)
+	return n, addr, err
+}
+
+// ReadFromControl reads from the filtered connection, parsing control messages
+func (r *filteredConn) ReadFromControl(b []byte) (n int, cm *ControlMessage, addr net.Addr, err error) {
+	return r.readFrom(context.Background(), b, true)
+}
 
-	if deadline, ok := r.deadline.Load().(time.Time); ok && !deadline.IsZero() {
-		timer := time.NewTimer(deadline.Sub(time.Now()))
-		timeout = timer.C
-		defer timer.Stop()
+func (r *filteredConn) readFrom(ctx context.Context, b []byte, control bool) (n int, cm *ControlMessage, addr net.Addr, err error) {
+	if err := r.checkState(); err != nil {
+		return 0, nil, nil, err
 	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, nil, err
+	}
+
+	timeout := r.readDeadline.wait()
 
 	select {
 	case <-timeout:
-		return 0, nil, errTimeout
+		return 0, nil, nil, errTimeout
+	case <-ctx.Done():
+		return 0, nil, nil, ctx.Err()
 	case msg := <-r.recvBuffer:
+		r.dequeued(msg)
 		n, _, err := copyBuffers(msg, b, nil)
+		if err == nil {
+			r.stats.delivered(n)
+			if msg.Flags&msgTrunc != 0 {
+				err = errTruncated
+			}
+			if control && msg.NN > 0 {
+				cm = parseControlMessage(msg.OOB[:msg.NN])
+			}
+		}
 
-		r.source.returnBuffers(msg.Message)
+		r.source.returnBuffers(msg)
 
-		return n, msg.Addr, err
+		return n, cm, msg.Addr, err
 	case <-r.closed:
-		return 0, nil, errClosed
+		return 0, nil, nil, errClosed
+	case <-r.source.failed:
+		return 0, nil, nil, r.source.err
 	}
 }
 
 func (r *filteredConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	return r.readBatch(context.Background(), ms, flags)
+}
+
+// ReadBatchContext is like ReadBatch, but returns the context's error if it is
+// done before a packet arrives.
+func (r *filteredConn) ReadBatchContext(ctx context.Context, ms []ipv4.Message, flags int) (int, error) {
+	return r.readBatch(ctx, ms, flags)
+}
+
+func (r *filteredConn) readBatch(ctx context.Context, ms []ipv4.Message, flags int) (int, error) {
 	if flags != 0 {
 		return 0, errNotSupported
 	}
 
-	if len(ms) == 0 {
-		return 0, nil
+	if err := r.checkState(); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
 	}
 
-	var timeout <-chan time.Time
-
-	if deadline, ok := r.deadline.Load().(time.Time); ok && !deadline.IsZero() {
-		timer := time.NewTimer(deadline.Sub(time.Now()))
-		timeout = timer.C
-		defer timer.Stop()
+	if len(ms) == 0 {
+		return 0, nil
 	}
 
-	msgs := make([]messageWithError, 0, len(ms))
+	timeout := r.readDeadline.wait()
 
-	defer func() {
-		for _, msg := range msgs {
-			r.source.returnBuffers(msg.Message)
+	// Check upfront, so that no message is lost to an unsupported layout.
+	for i := range ms {
+		if len(ms[i].Buffers) != 1 {
+			return 0, errNotSupported
 		}
-	}()
+	}
 
 	// We must read at least one message.
+	var msg messageWithError
 	select {
-	//goland:noinspection GoNilness
 	case <-timeout:
 		return 0, errTimeout
-	case msg := <-r.recvBuffer:
-		msgs = append(msgs, msg)
-		if msg.Err != nil {
-			return 0, msg.Err
-		}
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case msg = <-r.recvBuffer:
 	case <-r.closed:
 		return 0, errClosed
+	case <-r.source.failed:
+		return 0, r.source.err
 	}
 
 	// After that, it's best effort. If there are messages, we read them.
-	// If not, we break out and return what we got.
-loop:
-	for len(msgs) != len(ms) {
-		select {
-		case msg := <-r.recvBuffer:
-			msgs = append(msgs, msg)
-			if msg.Err != nil {
-				return 0, msg.Err
-			}
-		case <-r.closed:
-			return 0, errClosed
-		default:
-			break loop
+	// If not, we return what we got. Messages are copied out as they are
+	// received, so no intermediate slice is needed.
+	n := 0
+	for {
+		r.dequeued(msg)
+		err := r.readInto(msg, &ms[n])
+		r.source.returnBuffers(msg)
+		if err != nil {
+			return n, err
 		}
-	}
+		n++
 
-	for i, msg := range msgs {
-		if len(ms[i].Buffers) != 1 {
-			return 0, errNotSupported
+		if n == len(ms) {
+			return n, nil
 		}
-
-		n, nn, err := copyBuffers(msg, ms[i].Buffers[0], ms[i].OOB)
-		if err != nil {
-			return 0, err
+		select {
+		case msg = <-r.recvBuffer:
+		default:
+			return n, nil
 		}
+	}
+}
 
-		ms[i].N = n
-		ms[i].NN = nn
-		ms[i].Flags = msg.Flags
-		ms[i].Addr = msg.Addr
+// readInto copies a dequeued message into the given batch message.
+func (r *filteredConn) readInto(msg messageWithError, m *ipv4.Message) error {
+	n, nn, err := copyBuffers(msg, m.Buffers[0], m.OOB)
+	if err != nil {
+		return err
 	}
 
-	return len(msgs), nil
+	r.stats.delivered(n)
+
+	m.N = n
+	m.NN = nn
+	m.Flags = msg.Flags
+	m.Addr = msg.Addr
+	return nil
 }
 
 func copyBuffers(msg messageWithError, buf, oobBuf []byte) (n, nn int, err error) {
@@ -174,7 +497,7 @@ func copyBuffers(msg messageWithError, buf, oobBuf []byte) (n, nn int, err error
 		return 0, 0, io.ErrShortBuffer
 	}
 
-	copy(buf, msg.Buffers[0][:msg.N])
+	copy(buf, msg.Data())
 
 	// Truncate, probably?
 	oobn := msg.NN
@@ -190,16 +513,281 @@ func copyBuffers(msg messageWithError, buf, oobBuf []byte) (n, nn int, err error
 
 // Close closes the filtered connection, removing it's filters
 func (r *filteredConn) Close() error {
+	if !r.markClosed() {
+		return errClosed
+	}
+	r.source.removeConn(r)
+	r.drain()
+	return nil
+}
+
+// enqueue queues a claimed message for reading, applying the overflow policy
+// if the receive buffer or the byte budgets are exhausted. Buffers of messages
+// that get dropped are returned to the pool.
+func (r *filteredConn) enqueue(msg messageWithError) {
+	msg = r.source.compact(msg)
+	if r.replies != nil {
+		r.replies.learn(&msg)
+	}
+	size := msg.size()
+
+	var timeout <-chan time.Time
+	blocked := false
+
+	for {
+		reason := r.source.reserve(r, size)
+		if reason == overflowNone {
+			select {
+			case r.recvBuffer <- msg:
+				r.drainIfClosed()
+				return
+			default:
+				r.source.release(r, size)
+				reason = overflowBacklog
+			}
+		}
+
+		if !r.canFit(reason, size) {
+			r.overflowed(msg, reason)
+			return
+		}
+
+		switch r.policy {
+		case OverflowDropOldest:
+			// Readers might race us for the oldest message, in which case we
+			// should have room on the next attempt anyway.
+			select {
+			case old := <-r.recvBuffer:
+				r.dequeued(old)
+				r.stats.evicted(old.N)
+				atomic.AddUint64(&r.source.overflow, 1)
+				r.source.returnBuffers(old)
+				continue
+			default:
+			}
+			if reason == overflowBacklog && cap(r.recvBuffer) > 0 {
+				continue
+			}
+		case OverflowBlock:
+			if !blocked {
+				blocked = true
+				r.stats.blocked()
+				if r.blockTimeout > 0 {
+					timer := time.NewTimer(r.blockTimeout)
+					timeout = timer.C
+					defer timer.Stop()
+				}
+			}
+
+			// Only attempt a blocking send if the bytes fit, otherwise wait
+			// for readers to make room.
+			var send chan<- messageWithError
+			if reason == overflowBacklog && r.source.reserve(r, size) == overflowNone {
+				send = r.recvBuffer
+			}
+
+			select {
+			case send <- msg:
+				r.drainIfClosed()
+				return
+			case <-r.space:
+			case <-r.source.space:
+			case <-timeout:
+				if send != nil {
+					r.source.release(r, size)
+				}
+				r.stats.timedOut(msg.N)
+				atomic.AddUint64(&r.source.overflow, 1)
+				r.source.returnBuffers(msg)
+				return
+			case <-r.closed:
+			case <-r.source.closed:
+			}
+
+			if send != nil {
+				r.source.release(r, size)
+			}
+			if r.checkState() != nil {
+				r.source.returnBuffers(msg)
+				return
+			}
+			continue
+		}
+
+		r.overflowed(msg, reason)
+		return
+	}
+}
+
+// rateLimited returns true and counts the message if its sender exceeded the
+// connection's rate limit.
+func (r *filteredConn) rateLimited(msg *messageWithError) bool {
+	if r.limiter == nil || r.limiter.allow(msg.Addr, msg.ReceivedAt) {
+		return false
+	}
+	r.stats.rateLimited(msg.N)
+	atomic.AddUint64(&r.source.limited, 1)
+	return true
+}
+
+// canFit returns false if a message of the given size would not be queued,
+// even if the receive buffer was empty.
+func (r *filteredConn) canFit(reason overflowReason, size int) bool {
+	switch reason {
+	case overflowBacklog:
+		return cap(r.recvBuffer) > 0 || r.policy == OverflowBlock
+	case overflowConnBytes:
+		return size <= r.backlogBytes
+	case overflowMemory:
+		return size <= r.source.maxBufferedBytes
+	}
+	return true
+}
+
+func (r *filteredConn) overflowed(msg messageWithError, reason overflowReason) {
+	switch reason {
+	case overflowConnBytes:
+		r.stats.byteLimited(msg.N)
+	case overflowMemory:
+		r.stats.memoryLimited(msg.N)
+	default:
+		r.stats.overflowed(msg.N)
+	}
+	atomic.AddUint64(&r.source.overflow, 1)
+	r.source.returnBuffers(msg)
+}
+
+// dequeued should be called for every message taken out of the receive buffer.
+func (r *filteredConn) dequeued(msg messageWithError) {
+	r.source.release(r, msg.size())
+	select {
+	case r.space <- struct{}{}:
+	default:
+	}
+	select {
+	case r.source.space <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns a snapshot of the connection's counters.
+func (r *filteredConn) Stats() ConnStats {
+	r.source.mut.Lock()
+	defer r.source.mut.Unlock()
+	return r.statsLocked()
+}
+
+// statsLocked is Stats, to be called while holding the source's mutex.
+func (r *filteredConn) statsLocked() ConnStats {
+	stats := r.stats.snapshot()
+	stats.Name = r.name
+	if r.group != nil {
+		stats.Group = r.group.name
+	}
+	stats.Priority = r.priority
+	stats.QueueLength = len(r.recvBuffer)
+	stats.QueueBytes = int(atomic.LoadInt64(&r.queuedBytes))
+	return stats
+}
+
+// SetPriority changes the priority of the connection
+func (r *filteredConn) SetPriority(priority int) error {
+	return r.source.updateConn(r, func() error {
+		if r.group != nil {
+			return errGroupMember
+		}
+		r.priority = priority
+		return nil
+	})
+}
+
+// SetFilter replaces the filter of the connection
+func (r *filteredConn) SetFilter(filter Filter) error {
+	return r.source.updateConn(r, func() error {
+		if r.group != nil {
+			return errGroupMember
+		}
+		r.filter.Store(filterBox{filter})
+		return nil
+	})
+}
+
+func (r *filteredConn) loadFilter() Filter {
+	box, _ := r.filter.Load().(filterBox)
+	return box.Filter
+}
+
+// AddKey registers the connection for packets with the given key
+func (r *filteredConn) AddKey(key string) error {
+	return r.source.updateKeys(r, []string{key}, nil)
+}
+
+// RemoveKey unregisters the connection from the given key
+func (r *filteredConn) RemoveKey(key string) error {
+	return r.source.updateKeys(r, nil, []string{key})
+}
+
+// checkState returns an error if the connection is closed, or if the packet
+// filter has stopped due to an error on the underlying connection.
+func (r *filteredConn) checkState() error {
 	select {
 	case <-r.closed:
 		return errClosed
 	default:
 	}
-	close(r.closed)
-	r.source.removeConn(r)
+	return r.source.Err()
+}
+
+// checkWriteState is checkState for writes, which also fail once the write
+// deadline has passed.
+func (r *filteredConn) checkWriteState() error {
+	if err := r.checkState(); err != nil {
+		return err
+	}
+	if r.writeTimedOut() {
+		return errTimeout
+	}
 	return nil
 }
 
+func (r *filteredConn) writeTimedOut() bool {
+	return isClosedChan(r.writeDeadline.wait())
+}
+
+// markClosed closes the closed channel, returning false if it was already closed.
+func (r *filteredConn) markClosed() bool {
+	marked := false
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		marked = true
+	})
+	return marked
+}
+
+// drainIfClosed drains the receive buffer if the connection was closed. The
+// read loop uses a snapshot of connections, so it might deliver a message after
+// the connection was closed and drained, in which case it has to clean up.
+func (r *filteredConn) drainIfClosed() {
+	select {
+	case <-r.closed:
+		r.drain()
+	default:
+	}
+}
+
+// drain returns buffers of all queued messages back to the pool.
+func (r *filteredConn) drain() {
+	for {
+		select {
+		case msg := <-r.recvBuffer:
+			r.dequeued(msg)
+			r.source.returnBuffers(msg)
+		default:
+			return
+		}
+	}
+}
+
 func (r *filteredConn) SetReadBuffer(sz int) error {
 	if srb, ok := r.source.conn.(interface{ SetReadBuffer(int) error }); ok {
 		return srb.SetReadBuffer(sz)
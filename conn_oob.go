@@ -2,7 +2,6 @@ package pfilter
 
 import (
 	"net"
-	"time"
 
 	"github.com/quic-go/quic-go"
 )
@@ -14,31 +13,34 @@ type filteredConnObb struct {
 }
 
 func (r *filteredConnObb) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
-	return r.source.oobConn.WriteMsgUDP(b, oob, addr)
+	if err := r.checkWriteState(); err != nil {
+		return 0, 0, err
+	}
+	n, oobn, err = r.source.oobConn.WriteMsgUDP(b, oob, addr)
+	if err == nil {
+		r.stats.written(n)
+	}
+	return n, oobn, err
 }
 
 func (r *filteredConnObb) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
-	select {
-	case <-r.closed:
-		return 0, 0, 0, nil, errClosed
-	default:
+	if err := r.checkState(); err != nil {
+		return 0, 0, 0, nil, err
 	}
 
-	var timeout <-chan time.Time
-
-	if deadline, ok := r.deadline.Load().(time.Time); ok && !deadline.IsZero() {
-		timer := time.NewTimer(deadline.Sub(time.Now()))
-		timeout = timer.C
-		defer timer.Stop()
-	}
+	timeout := r.readDeadline.wait()
 
 	select {
 	case <-timeout:
 		return 0, 0, 0, nil, errTimeout
 	case msg := <-r.recvBuffer:
+		r.dequeued(msg)
 		n, nn, err := copyBuffers(msg, b, oob)
+		if err == nil {
+			r.stats.delivered(n)
+		}
 
-		r.source.returnBuffers(msg.Message)
+		r.source.returnBuffers(msg)
 
 		udpAddr, ok := msg.Addr.(*net.UDPAddr)
 		if !ok && err == nil {
@@ -48,5 +50,7 @@ func (r *filteredConnObb) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *n
 		return n, nn, msg.Flags, udpAddr, err
 	case <-r.closed:
 		return 0, 0, 0, nil, errClosed
+	case <-r.source.failed:
+		return 0, 0, 0, nil, r.source.err
 	}
 }
@@ -1,12 +1,17 @@
 package pfilter
 
 import (
+	"errors"
 	"io"
 	"math/rand"
 	"net"
+	"os"
 	"runtime"
 	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
 )
 
 const packetSize = 1500
@@ -47,6 +52,152 @@ func BenchmarkPacketConnPfilter(b *testing.B) {
 	benchmark(b, client, &readerWrapper{pfilterServer}, packetSize)
 }
 
+// newBatchPair returns a client connected to a started packet filter, and a
+// virtual connection receiving everything the client sends.
+func newBatchPair(tb testing.TB) (net.Conn, Conn) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { server.Close() })
+
+	pfilter := NewPacketFilter(server)
+	conn := pfilter.NewConn(10, nil).(Conn)
+	pfilter.Start()
+	tb.Cleanup(func() { pfilter.Close() })
+
+	client, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { client.Close() })
+	return client, conn
+}
+
+// sendAndReadBatch sends len(ms) packets and reads them back via ReadBatch,
+// going through the socket and the read loop.
+func sendAndReadBatch(tb testing.TB, client net.Conn, conn Conn, data []byte, ms []ipv4.Message) {
+	for range ms {
+		if _, err := client.Write(data); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	for read := 0; read < len(ms); {
+		n, err := conn.ReadBatch(ms[read:], 0)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		read += n
+	}
+}
+
+func BenchmarkReadBatch(b *testing.B) {
+	client, conn := newBatchPair(b)
+
+	const batchSize = 8
+	ms := make([]ipv4.Message, batchSize)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, packetSize)}
+	}
+	data := make([]byte, packetSize)
+
+	b.ReportAllocs()
+	b.SetBytes(batchSize * packetSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sendAndReadBatch(b, client, conn, data, ms)
+	}
+}
+
+// TestReadBatchAllocs checks that the batch read path reuses its buffers,
+// message arrays and the addresses of remote senders.
+func TestReadBatchAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("golang.org/x/net/ipv4 allocates the address of every message")
+	}
+	client, conn := newBatchPair(t)
+
+	const batchSize = 8
+	ms := make([]ipv4.Message, batchSize)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, packetSize)}
+	}
+	data := make([]byte, 100)
+
+	// Warm up the buffer pool and the addresses of all batch slots.
+	for i := 0; i < 10; i++ {
+		sendAndReadBatch(t, client, conn, data, ms)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		sendAndReadBatch(t, client, conn, data, ms)
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per batch, expected none", allocs)
+	}
+}
+
+func TestReadBatchAddrs(t *testing.T) {
+	for _, network := range []string{"udp4", "udp6"} {
+		t.Run(network, func(t *testing.T) {
+			loopback := "127.0.0.1:0"
+			if network == "udp6" {
+				loopback = "[::1]:0"
+			}
+			server, err := net.ListenPacket(network, loopback)
+			if err != nil {
+				t.Skip(err)
+			}
+			defer server.Close()
+
+			pf := NewPacketFilter(server)
+			conn := pf.NewConn(10, nil).(Conn)
+			pf.Start()
+			defer pf.Close()
+
+			var clients []net.Conn
+			for i := 0; i < 3; i++ {
+				client, err := net.Dial(network, server.LocalAddr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer client.Close()
+				clients = append(clients, client)
+			}
+
+			// Senders take turns, so each slot of the batch sees several.
+			const packets = 30
+			for i := 0; i < packets; i++ {
+				if _, err := clients[i%3].Write([]byte{byte(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			ms := make([]ipv4.Message, 8)
+			for i := range ms {
+				ms[i].Buffers = [][]byte{make([]byte, 10)}
+			}
+			for read := 0; read < packets; {
+				n, err := conn.ReadBatch(ms, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, m := range ms[:n] {
+					i := int(m.Buffers[0][0])
+					if m.N != 1 || m.Addr.String() != clients[i%3].LocalAddr().String() {
+						t.Fatalf("packet %d from %v, expected %v", i, m.Addr, clients[i%3].LocalAddr())
+					}
+				}
+				read += n
+			}
+		})
+	}
+}
+
 func benchmark(b *testing.B, client io.Writer, server io.Reader, sz int) {
 	data := make([]byte, sz)
 	if _, err := rand.Read(data); err != nil {
@@ -61,13 +212,14 @@ func benchmark(b *testing.B, client io.Writer, server io.Reader, sz int) {
 		go func() {
 			defer wg.Done()
 			if err := sendMsg(client, data); err != nil {
-				b.Fatal(err)
+				b.Error(err)
 			}
 		}()
 		go func() {
 			defer wg.Done()
 			if err := recvMsg(server, data); err != nil {
-				b.Fatal(err)
+				b.Error(err)
+				return
 			}
 			total += sz
 		}()
@@ -146,3 +298,149 @@ func TestShortRead(t *testing.T) {
 		t.Error("unexpected error condition", ok, nerr.Temporary())
 	}
 }
+
+// TestReadDeadline follows the deadline tests of golang.org/x/net/nettest,
+// for each of the read methods of virtual connections.
+func TestReadDeadline(t *testing.T) {
+	readers := map[string]func(conn *filteredConn) error{
+		"ReadFrom": func(conn *filteredConn) error {
+			_, _, err := conn.ReadFrom(make([]byte, 10))
+			return err
+		},
+		"ReadBatch": func(conn *filteredConn) error {
+			_, err := conn.ReadBatch([]ipv4.Message{{Buffers: [][]byte{make([]byte, 10)}}}, 0)
+			return err
+		},
+		"ReadMsgUDP": func(conn *filteredConn) error {
+			_, _, _, _, err := (&filteredConnObb{conn}).ReadMsgUDP(make([]byte, 10), nil)
+			return err
+		},
+	}
+
+	checkTimeout := func(t *testing.T, err error) {
+		t.Helper()
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("expected timeout, got %v", err)
+		}
+	}
+
+	for name, read := range readers {
+		read := read
+		t.Run(name, func(t *testing.T) {
+			server, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+
+			pf := NewPacketFilter(server)
+			defer pf.Close()
+			conn := unwrapConn(pf.NewConn(10, nil))
+			defer conn.Close()
+
+			async := func() <-chan error {
+				errs := make(chan error, 1)
+				go func() { errs <- read(conn) }()
+				return errs
+			}
+
+			t.Run("Past", func(t *testing.T) {
+				_ = conn.SetReadDeadline(time.Now().Add(-time.Second))
+				for i := 0; i < 3; i++ {
+					checkTimeout(t, read(conn))
+				}
+			})
+
+			t.Run("MovedIntoThePast", func(t *testing.T) {
+				_ = conn.SetReadDeadline(time.Now().Add(time.Hour))
+				errs := async()
+				time.Sleep(10 * time.Millisecond)
+				_ = conn.SetReadDeadline(aLongTimeAgo)
+				select {
+				case err := <-errs:
+					checkTimeout(t, err)
+				case <-time.After(5 * time.Second):
+					t.Fatal("blocked read was not interrupted")
+				}
+			})
+
+			t.Run("Extended", func(t *testing.T) {
+				start := time.Now()
+				_ = conn.SetReadDeadline(start.Add(20 * time.Millisecond))
+				errs := async()
+				_ = conn.SetReadDeadline(start.Add(100 * time.Millisecond))
+				checkTimeout(t, <-errs)
+				if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+					t.Errorf("read returned after %v, before the extended deadline", elapsed)
+				}
+			})
+
+			t.Run("Cleared", func(t *testing.T) {
+				_ = conn.SetReadDeadline(aLongTimeAgo)
+				checkTimeout(t, read(conn))
+				_ = conn.SetReadDeadline(time.Time{})
+				errs := async()
+				conn.enqueue(messageWithError{Buf: pf.alloc.Get(packetSize), Addr: server.LocalAddr(), N: 5})
+				if err := <-errs; err != nil {
+					t.Errorf("unexpected error after clearing the deadline: %v", err)
+				}
+			})
+
+			t.Run("Close", func(t *testing.T) {
+				_ = conn.SetReadDeadline(time.Time{})
+				errs := async()
+				time.Sleep(10 * time.Millisecond)
+				_ = conn.Close()
+				if err := <-errs; err != errClosed {
+					t.Errorf("expected closed error, got %v", err)
+				}
+			})
+		})
+	}
+}
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+func TestWriteDeadline(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	pf := NewPacketFilter(server)
+	defer pf.Close()
+	stun := pf.NewConn(5, nil)
+	quic := pf.NewConn(10, nil)
+
+	checkTimeout := func(err error) {
+		t.Helper()
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("expected timeout, got %v", err)
+		}
+	}
+
+	_ = stun.SetDeadline(aLongTimeAgo)
+	_, err = stun.WriteTo([]byte("hello"), server.LocalAddr())
+	checkTimeout(err)
+	_, _, err = stun.(*filteredConnObb).WriteMsgUDP([]byte("hello"), nil, server.LocalAddr().(*net.UDPAddr))
+	checkTimeout(err)
+	_, err = unwrapConn(stun).WriteBatch([]ipv4.Message{{Buffers: [][]byte{[]byte("hello")}, Addr: server.LocalAddr()}}, 0)
+	checkTimeout(err)
+	if stats := unwrapConn(stun).Stats(); stats.PacketsWritten != 0 {
+		t.Errorf("writes went through despite the deadline %+v", stats)
+	}
+
+	// Other connections and the underlying connection are not affected.
+	if _, err := quic.WriteTo([]byte("hello"), server.LocalAddr()); err != nil {
+		t.Error(err)
+	}
+	if _, err := server.WriteTo([]byte("hello"), server.LocalAddr()); err != nil {
+		t.Error(err)
+	}
+
+	_ = stun.SetWriteDeadline(time.Now().Add(time.Hour))
+	if _, err := stun.WriteTo([]byte("hello"), server.LocalAddr()); err != nil {
+		t.Error(err)
+	}
+}
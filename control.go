@@ -0,0 +1,44 @@
+package pfilter
+
+import (
+	"net"
+	"time"
+)
+
+// ControlFlags selects the packet metadata the underlying socket is asked to
+// report, via Config.Control.
+type ControlFlags int
+
+const (
+	// ControlDst reports the destination address of packets.
+	ControlDst ControlFlags = 1 << iota
+	// ControlInterface reports the index of the interface packets arrived on.
+	ControlInterface
+	// ControlHopLimit reports the IPv4 TTL or the IPv6 hop limit.
+	ControlHopLimit
+	// ControlTrafficClass reports the IPv4 TOS or the IPv6 traffic class,
+	// including the ECN bits.
+	ControlTrafficClass
+	// ControlTimestamp reports the time the kernel received packets at.
+	ControlTimestamp
+)
+
+// ControlMessage is the metadata of a received packet. Fields are only set if
+// requested via Config.Control, and reported by the platform.
+type ControlMessage struct {
+	// Destination address of the packet.
+	Dst net.IP
+	// Index of the interface the packet arrived on.
+	IfIndex int
+	// IPv4 TTL or IPv6 hop limit.
+	HopLimit int
+	// IPv4 TOS or IPv6 traffic class.
+	TrafficClass int
+	// Time the kernel received the packet at.
+	Timestamp time.Time
+}
+
+// ECN returns the ECN codepoint, the two low bits of the traffic class.
+func (cm *ControlMessage) ECN() int {
+	return cm.TrafficClass & 0x3
+}
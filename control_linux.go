@@ -0,0 +1,110 @@
+package pfilter
+
+import (
+	"net"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// enableControl enables the socket options reporting the requested metadata.
+func enableControl(conn *net.UDPConn, flags ControlFlags) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		var domain int
+		domain, serr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if serr != nil {
+			return
+		}
+
+		var v4, v6 []int
+		if flags&(ControlDst|ControlInterface) != 0 {
+			v4 = append(v4, unix.IP_PKTINFO)
+			v6 = append(v6, unix.IPV6_RECVPKTINFO)
+		}
+		if flags&ControlHopLimit != 0 {
+			v4 = append(v4, unix.IP_RECVTTL)
+			v6 = append(v6, unix.IPV6_RECVHOPLIMIT)
+		}
+		if flags&ControlTrafficClass != 0 {
+			v4 = append(v4, unix.IP_RECVTOS)
+			v6 = append(v6, unix.IPV6_RECVTCLASS)
+		}
+		if flags&ControlTimestamp != 0 {
+			if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1); serr != nil {
+				return
+			}
+		}
+
+		if domain == unix.AF_INET6 {
+			for _, opt := range v6 {
+				if serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, opt, 1); serr != nil {
+					return
+				}
+			}
+		}
+		for _, opt := range v4 {
+			err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, opt, 1)
+			// Dual stack sockets only need these for IPv4-mapped traffic, so
+			// failures are fine if the socket is IPv6 only.
+			if err != nil && domain != unix.AF_INET6 {
+				serr = err
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// parseControlMessage parses the control messages of a received packet,
+// returning nil if there are none.
+func parseControlMessage(oob []byte) *ControlMessage {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil || len(msgs) == 0 {
+		return nil
+	}
+
+	cm := &ControlMessage{}
+	for _, msg := range msgs {
+		data := msg.Data
+		switch msg.Header.Level {
+		case unix.IPPROTO_IP:
+			switch {
+			case msg.Header.Type == unix.IP_PKTINFO && len(data) >= unix.SizeofInet4Pktinfo:
+				info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+				cm.Dst = net.IPv4(info.Addr[0], info.Addr[1], info.Addr[2], info.Addr[3])
+				cm.IfIndex = int(info.Ifindex)
+			case msg.Header.Type == unix.IP_TTL && len(data) >= 4:
+				cm.HopLimit = int(*(*int32)(unsafe.Pointer(&data[0])))
+			case msg.Header.Type == unix.IP_TOS && len(data) >= 1:
+				cm.TrafficClass = int(data[0])
+			}
+		case unix.IPPROTO_IPV6:
+			switch {
+			case msg.Header.Type == unix.IPV6_PKTINFO && len(data) >= unix.SizeofInet6Pktinfo:
+				info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+				cm.Dst = append(net.IP(nil), info.Addr[:]...)
+				cm.IfIndex = int(info.Ifindex)
+			case msg.Header.Type == unix.IPV6_HOPLIMIT && len(data) >= 4:
+				cm.HopLimit = int(*(*int32)(unsafe.Pointer(&data[0])))
+			case msg.Header.Type == unix.IPV6_TCLASS && len(data) >= 4:
+				cm.TrafficClass = int(*(*int32)(unsafe.Pointer(&data[0])))
+			}
+		case unix.SOL_SOCKET:
+			if msg.Header.Type == unix.SCM_TIMESTAMPNS && len(data) >= int(unsafe.Sizeof(unix.Timespec{})) {
+				ts := (*unix.Timespec)(unsafe.Pointer(&data[0]))
+				cm.Timestamp = time.Unix(ts.Unix())
+			}
+		}
+	}
+	return cm
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package pfilter
+
+import (
+	"net"
+)
+
+func enableControl(*net.UDPConn, ControlFlags) error {
+	return errNotSupported
+}
+
+func parseControlMessage([]byte) *ControlMessage {
+	return nil
+}
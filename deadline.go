@@ -0,0 +1,73 @@
+package pfilter
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline is a deadline which wakes up waiters when it passes, or when it is
+// moved into the past. Modelled after the deadline of net.Pipe.
+type deadline struct {
+	mut    sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // Closed once the deadline has passed.
+}
+
+func newDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline, a zero value meaning no deadline. Waiters blocked on
+// the channel returned by wait keep waiting if the deadline is moved into the
+// future, and are woken up if it is moved into the past.
+func (d *deadline) set(t time.Time) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	// Time is zero, then there is no deadline.
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	// Time in the future, setup a timer to cancel in the future.
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	// Time in the past, so close immediately.
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,139 @@
+package pfilter
+
+import (
+	"net"
+	"sort"
+)
+
+// dispatchTable is an immutable snapshot of the connections, used by the read
+// loop without locking.
+type dispatchTable struct {
+	// All connections, ordered by priority.
+	conns []*filteredConn
+	// Connections and groups that get to claim packets via their filter,
+	// ordered by priority.
+	slots []dispatchSlot
+	// Connections by the keys they registered for.
+	keys map[string]*filteredConn
+}
+
+// dispatchSlot is either a single connection, or a group of connections
+// sharing a filter.
+type dispatchSlot struct {
+	conn    *filteredConn
+	group   *connGroup
+	members []*filteredConn
+}
+
+func (s *dispatchSlot) order() (int, uint64) {
+	if s.group != nil {
+		return s.group.priority, s.group.seq
+	}
+	return s.conn.priority, s.conn.seq
+}
+
+// newDispatchTable builds a table from the given connections, which it takes
+// ownership of. Should be called while holding the source's mutex.
+func newDispatchTable(conns []*filteredConn, groups map[string]*connGroup) *dispatchTable {
+	sort.Sort(filteredConnList(conns))
+	table := &dispatchTable{
+		conns: conns,
+		slots: make([]dispatchSlot, 0, len(conns)+len(groups)),
+	}
+
+	members := make(map[*connGroup][]*filteredConn, len(groups))
+	for _, conn := range conns {
+		if conn.group != nil {
+			members[conn.group] = append(members[conn.group], conn)
+			continue
+		}
+		// Keyed connections without a filter would otherwise claim everything.
+		if conn.loadFilter() != nil || !conn.keyed {
+			table.slots = append(table.slots, dispatchSlot{conn: conn})
+		}
+		for key := range conn.keys {
+			if table.keys == nil {
+				table.keys = make(map[string]*filteredConn)
+			}
+			table.keys[key] = conn
+		}
+	}
+	for _, group := range groups {
+		table.slots = append(table.slots, dispatchSlot{group: group, members: members[group]})
+	}
+
+	sort.Slice(table.slots, func(i, j int) bool {
+		pi, si := table.slots[i].order()
+		pj, sj := table.slots[j].order()
+		if pi != pj {
+			return pi < pj
+		}
+		return si < sj
+	})
+	return table
+}
+
+// lookup returns the connection registered for the packet's key, if any.
+func (t *dispatchTable) lookup(keyFunc KeyFunc, msg messageWithError) *filteredConn {
+	if keyFunc == nil || len(t.keys) == 0 {
+		return nil
+	}
+	key, ok := keyFunc(msg.Data(), msg.Addr)
+	if !ok {
+		return nil
+	}
+	return t.keys[key]
+}
+
+// verdict decides what should happen to the message, and which connection it
+// should go to if it's claimed or copied.
+func (s *dispatchSlot) verdict(msg *messageWithError) (Verdict, *filteredConn) {
+	if s.group == nil {
+		return verdictOf(s.conn.loadFilter(), msg), s.conn
+	}
+	if len(s.members) == 0 {
+		return VerdictPass, nil
+	}
+	verdict := verdictOf(s.group.filter, msg)
+	if verdict == VerdictClaim || verdict == VerdictCopy {
+		return verdict, s.group.pick(s.members, msg.Addr)
+	}
+	return verdict, nil
+}
+
+func verdictOf(filter Filter, msg *messageWithError) Verdict {
+	switch filter := filter.(type) {
+	case nil:
+		return VerdictClaim
+	case ContextFilter:
+		return filter.Inspect(msg.packet())
+	case VerdictFilter:
+		return filter.Verdict(msg.Data(), msg.Addr)
+	default:
+		if filter.ClaimIncoming(msg.Data(), msg.Addr) {
+			return VerdictClaim
+		}
+		return VerdictPass
+	}
+}
+
+// addrHash hashes the remote address using FNV-1a, avoiding allocations for
+// UDP addresses.
+func addrHash(addr net.Addr) uint32 {
+	const prime = 16777619
+	hash := uint32(2166136261)
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		for _, b := range addr.IP.To16() {
+			hash = (hash ^ uint32(b)) * prime
+		}
+		hash = (hash ^ uint32(addr.Port&0xff)) * prime
+		hash = (hash ^ uint32(addr.Port>>8)) * prime
+	case nil:
+	default:
+		for _, b := range []byte(addr.String()) {
+			hash = (hash ^ uint32(b)) * prime
+		}
+	}
+	return hash
+}
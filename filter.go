@@ -7,6 +7,7 @@ import (
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/quic-go/quic-go"
 	"golang.org/x/net/ipv4"
@@ -26,6 +27,92 @@ type Filter interface {
 	ClaimIncoming([]byte, net.Addr) bool
 }
 
+// Verdict is the decision of a VerdictFilter about an incoming packet.
+type Verdict int
+
+const (
+	// VerdictPass leaves the packet to lower priority connections.
+	VerdictPass Verdict = iota
+	// VerdictClaim delivers the packet to the connection.
+	VerdictClaim
+	// VerdictCopy delivers a copy of the packet to the connection, and keeps
+	// offering the packet to lower priority connections.
+	VerdictCopy
+	// VerdictDrop discards the packet, without offering it to lower priority
+	// connections.
+	VerdictDrop
+)
+
+// DropReason tells why a packet was not delivered to any connection.
+type DropReason int
+
+const (
+	// DropUnclaimed means no connection claimed the packet.
+	DropUnclaimed DropReason = iota
+	// DropRejected means a filter returned VerdictDrop.
+	DropRejected
+	// DropTruncated means the packet was larger than Config.BufferSize, and
+	// Config.DropTruncated is set.
+	DropTruncated
+	// DropRateLimited means the sender exceeded Config.RateLimit, or the
+	// ConnConfig.RateLimit of the connection the packet was meant for.
+	DropRateLimited
+	// DropDenied means the sender is denied by the ACL of the packet filter,
+	// as set via Config.ACL or SetACL.
+	DropDenied
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropUnclaimed:
+		return "unclaimed"
+	case DropRejected:
+		return "rejected"
+	case DropTruncated:
+		return "truncated"
+	case DropRateLimited:
+		return "rate limited"
+	case DropDenied:
+		return "denied"
+	default:
+		return "unknown"
+	}
+}
+
+// UnclaimedHandler receives the payload, control messages and remote address
+// of a packet that is about to be dropped, along with the reason it is dropped.
+type UnclaimedHandler func(data, oob []byte, addr net.Addr, reason DropReason)
+
+// VerdictFilter is a Filter which can also copy or drop packets, rather than
+// only claim them. If a connection's filter implements VerdictFilter, Verdict
+// is called instead of ClaimIncoming.
+type VerdictFilter interface {
+	Filter
+	Verdict([]byte, net.Addr) Verdict
+}
+
+// Packet is the context of a received packet, as passed to ContextFilter.
+type Packet struct {
+	// Payload of the packet, which must not be retained.
+	Data []byte
+	// Remote address the packet was received from.
+	Addr net.Addr
+	// Metadata of the packet enabled via Config.Control, or nil if none was
+	// received.
+	Control *ControlMessage
+	// Time the packet was read from the underlying connection.
+	ReceivedAt time.Time
+}
+
+// ContextFilter is a Filter which decides based on the full context of the
+// packet, rather than only its payload and remote address. If a connection's
+// filter implements ContextFilter, Inspect is called instead of Verdict or
+// ClaimIncoming.
+type ContextFilter interface {
+	Filter
+	Inspect(*Packet) Verdict
+}
+
 type Config struct {
 	Conn net.PacketConn
 
@@ -33,12 +120,87 @@ type Config struct {
 	// socket. Buffer that is too small could result in truncated reads. Defaults to 15000
 	BufferSize int
 
+	// If true, datagrams larger than BufferSize are dropped. Otherwise they are
+	// delivered truncated, with the MSG_TRUNC flag set for batch and
+	// ReadMsgUDP reads, and with a temporary error alongside the data for
+	// ReadFrom.
+	DropTruncated bool
+
 	// Backlog of how many packets we are happy to buffer in memory
 	Backlog int
 
+	// If non-zero, limits the total memory held by packets buffered across all
+	// connections. Packets account for the capacity of their payload and
+	// control message buffers, so a small packet still counts the full read
+	// buffer unless CompactThreshold is set.
+	MaxBufferedBytes int
+
 	// If non-zero, uses ipv4.PacketConn.ReadBatch, using the size of the batch given.
-	// Defaults to 1 on Darwin/FreeBSD and 8 on Linux.
+	// Defaults to 1 on Darwin/FreeBSD and 8 on Linux. On Linux, batches are read
+	// without allocating, so packets from the same sender may share the same
+	// *net.UDPAddr, which must not be modified.
 	BatchSize int
+
+	// Provides the buffers packets are read into. Read buffers are one byte
+	// larger than BufferSize, so that truncation can be detected on every
+	// read path. Defaults to an allocator with size classes for read
+	// buffers, OOBBufferSize and powers of two in between.
+	Allocator Allocator
+
+	// Size of the buffers control messages are read into, when the underlying
+	// connection supports reading them. Defaults to 256.
+	OOBBufferSize int
+
+	// If non-zero, enables the socket options reporting the selected packet
+	// metadata, which is then available via Conn.ReadFromControl. Requires
+	// Conn to be a *net.UDPConn, and is only supported on Linux.
+	Control ControlFlags
+
+	// If true, enables UDP generic receive offload, letting the kernel coalesce
+	// datagrams of the same flow. Coalesced datagrams are split back up before
+	// being filtered. Requires Conn to be a *net.UDPConn and BufferSize to be
+	// at least 65535, and is only supported on Linux.
+	GRO bool
+
+	// If true, Conn.WriteSegments sends all segments with a single system
+	// call, using UDP generic segmentation offload. Requires Conn to be a
+	// *net.UDPConn, and is only supported on Linux.
+	GSO bool
+
+	// If non-zero, packets of at most this many bytes are moved into buffers
+	// sized to fit them before being queued, releasing the BufferSize sized
+	// read buffer. Only useful with an allocator that has smaller size classes.
+	CompactThreshold int
+
+	// Default overflow policy for connections that do not set their own.
+	// Defaults to OverflowDropNewest.
+	OverflowPolicy OverflowPolicy
+
+	// Default time the OverflowBlock policy waits for space in the receive
+	// buffer, before dropping the packet. Zero means waiting indefinitely.
+	BlockTimeout time.Duration
+
+	// If set, packets are first delivered to the connection that registered
+	// for the key returned by the function, via ConnConfig.Keys or AddKey,
+	// before being offered to connection filters in order of priority.
+	KeyFunc KeyFunc
+
+	// If set, called with packets that are about to be dropped without being
+	// delivered to any connection. Called from the read loop, so it should not
+	// block, and must not retain the slices passed to it.
+	UnclaimedHandler UnclaimedHandler
+
+	// Limits the rate of packets from each remote address, before they are
+	// offered to any connection.
+	RateLimit RateLimit
+
+	// If set, packets from remote addresses the ACL denies are dropped before
+	// being offered to any connection. Can be replaced via SetACL.
+	ACL *ACL
+
+	// If true, closing the packet filter also closes the underlying connection.
+	// Otherwise, the connection is left open and usable after Close returns.
+	CloseConn bool
 }
 
 // NewPacketFilter creates a packet filter object wrapping the given packet
@@ -72,21 +234,103 @@ func NewPacketFilterWithConfig(config Config) (*PacketFilter, error) {
 	if config.Backlog < 0 {
 		return nil, errors.New("negative backlog")
 	}
+	if !config.OverflowPolicy.valid() {
+		return nil, errors.New("invalid overflow policy")
+	}
+	if config.BlockTimeout < 0 {
+		return nil, errors.New("negative block timeout")
+	}
+	if config.MaxBufferedBytes < 0 {
+		return nil, errors.New("negative max buffered bytes")
+	}
+	if !config.RateLimit.valid() {
+		return nil, errInvalidRateLimit
+	}
+	if config.OOBBufferSize < 0 {
+		return nil, errors.New("negative oob buffer size")
+	}
+	if config.CompactThreshold < 0 {
+		return nil, errors.New("negative compact threshold")
+	}
+	if config.Control != 0 {
+		udpConn, ok := config.Conn.(*net.UDPConn)
+		if !ok {
+			return nil, errors.New("control messages require a *net.UDPConn")
+		}
+		if err := enableControl(udpConn, config.Control); err != nil {
+			return nil, err
+		}
+	}
+	if config.GRO || config.GSO {
+		udpConn, ok := config.Conn.(*net.UDPConn)
+		if !ok {
+			return nil, errors.New("offload requires a *net.UDPConn")
+		}
+		if config.GRO {
+			if config.BufferSize < maxDatagramSize {
+				return nil, errors.New("receive offload requires a buffer size of at least 65535")
+			}
+			if err := enableGRO(udpConn); err != nil {
+				return nil, err
+			}
+		}
+		if config.GSO {
+			if err := checkGSO(udpConn); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if config.OOBBufferSize == 0 {
+		config.OOBBufferSize = defaultOOBBufferSize
+	}
+	if config.Allocator == nil {
+		// Every queued message holds a payload and possibly a control buffer.
+		perClass := 2 * (config.Backlog + config.BatchSize + 1)
+		config.Allocator = NewSizeClassAllocator(perClass, defaultSizeClasses(config.BufferSize+1, config.OOBBufferSize)...)
+	}
+	if config.OverflowPolicy == OverflowDefault {
+		config.OverflowPolicy = OverflowDropNewest
+	}
 
 	d := &PacketFilter{
-		conn:       config.Conn,
-		packetSize: config.BufferSize,
-		backlog:    config.Backlog,
-		batchSize:  config.BatchSize,
-		bufPool: sync.Pool{
-			New: func() interface{} {
-				return make([]byte, config.BufferSize)
-			},
-		},
-	}
-	if config.BatchSize > 0 {
-		if _, ok := config.Conn.(*net.UDPConn); ok {
-			d.ipv4Conn = ipv4.NewPacketConn(config.Conn)
+		conn:             config.Conn,
+		packetSize:       config.BufferSize,
+		dropTruncated:    config.DropTruncated,
+		control:          config.Control,
+		gro:              config.GRO,
+		oobSize:          config.OOBBufferSize,
+		compactThreshold: config.CompactThreshold,
+		alloc:            config.Allocator,
+		backlog:          config.Backlog,
+		maxBufferedBytes: config.MaxBufferedBytes,
+		batchSize:        config.BatchSize,
+		closeConn:        config.CloseConn,
+		policy:           config.OverflowPolicy,
+		blockTime:        config.BlockTimeout,
+		keyFunc:          config.KeyFunc,
+		unclaimed:        config.UnclaimedHandler,
+		limiter:          newRateLimiter(config.RateLimit),
+		space:            make(chan struct{}, 1),
+		closed:           make(chan struct{}),
+		done:             make(chan struct{}),
+		failed:           make(chan struct{}),
+		results:          make([]messageWithError, 1),
+	}
+	d.SetACL(config.ACL)
+	if config.GSO {
+		d.gso = 1
+	}
+	if udpConn, ok := config.Conn.(*net.UDPConn); ok {
+		// Also used for batch writes, which are not affected by BatchSize.
+		d.ipv4Conn = ipv4.NewPacketConn(config.Conn)
+		if config.BatchSize > 0 {
+			d.batchReader = newBatchReader(udpConn, d.ipv4Conn, config.BatchSize)
+			d.batch = make([]ipv4.Message, config.BatchSize)
+			d.batchBufs = make([][]byte, config.BatchSize)
+			for i := range d.batch {
+				d.batch[i].Buffers = d.batchBufs[i : i+1 : i+1]
+			}
+			d.results = make([]messageWithError, config.BatchSize)
 		}
 	}
 	if oobConn, ok := d.conn.(quic.OOBCapablePacketConn); ok {
@@ -98,61 +342,354 @@ func NewPacketFilterWithConfig(config Config) (*PacketFilter, error) {
 // PacketFilter embeds a net.PacketConn to perform the filtering.
 type PacketFilter struct {
 	// Alignment
-	dropped  uint64
-	overflow uint64
+	dropped     uint64
+	overflow    uint64
+	claimed     uint64
+	copied      uint64
+	rejected    uint64
+	truncated   uint64
+	limited     uint64
+	denied      uint64
+	queuedBytes int64
+
+	conn             net.PacketConn
+	oobConn          quic.OOBCapablePacketConn
+	ipv4Conn         *ipv4.PacketConn
+	batchReader      batchReader
+	packetSize       int
+	dropTruncated    bool
+	control          ControlFlags
+	gro              bool
+	gso              int32 // Cleared if segmented sends turn out to fail.
+	oobSize          int
+	compactThreshold int
+	backlog          int
+	maxBufferedBytes int
+	batchSize        int
+	closeConn        bool
+	policy           OverflowPolicy
+	blockTime        time.Duration
+	alloc            Allocator
+
+	// Reused by the readers, so only touched by the read loop. Slots of the
+	// batch keep their buffers until a message is read into them.
+	batch     []ipv4.Message
+	batchBufs [][]byte
+	results   []messageWithError
+
+	// Signalled whenever a message is taken out of any receive buffer.
+	space chan struct{}
+
+	keyFunc   KeyFunc
+	unclaimed UnclaimedHandler
+	limiter   *rateLimiter
+	// Holds an aclBox.
+	acl atomic.Value
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+
+	// err is only written once, before failed is closed.
+	failed chan struct{}
+	err    error
 
-	conn       net.PacketConn
-	oobConn    quic.OOBCapablePacketConn
-	ipv4Conn   *ipv4.PacketConn
-	packetSize int
-	backlog    int
-	batchSize  int
-	bufPool    sync.Pool
+	// Copy-on-write *dispatchTable read by the read loop without locking.
+	// Replaced as a whole while holding mut.
+	table   atomic.Value
+	groups  map[string]*connGroup
+	retired map[string]*ConnStats // Counters of closed connections, by name.
+	started bool
+	nextSeq uint64
+	mut     sync.Mutex
+}
+
+// ConnConfig configures a virtual connection created via NewConnWithConfig.
+type ConnConfig struct {
+	// Priority decides which connection gets the ability to claim the packet,
+	// connections with lower values get to claim packets first.
+	Priority int
+
+	// Filter decides which packets the connection receives. If nil, the
+	// connection will receive all packets.
+	Filter Filter
+
+	// Name identifies the connection in statistics. Does not need to be unique.
+	Name string
+
+	// If non-zero, limits the memory held by packets buffered for the
+	// connection, in addition to the packet count limit set by Config.Backlog.
+	// Packets are accounted for as in Config.MaxBufferedBytes.
+	BacklogBytes int
+
+	// OverflowPolicy decides what happens to claimed packets when the receive
+	// buffer is full. Defaults to the policy set in Config.
+	OverflowPolicy OverflowPolicy
+
+	// BlockTimeout is used by the OverflowBlock policy. Defaults to the timeout
+	// set in Config.
+	BlockTimeout time.Duration
+
+	// Keys the connection receives packets for, as extracted by Config.KeyFunc.
+	// Keyed connections with a nil Filter only receive packets via their keys.
+	Keys []string
 
-	conns []*filteredConn
-	mut   sync.Mutex
+	// Group to join, as created by NewGroup. Members of a group share the
+	// group's priority and filter, so Priority is ignored, and Filter and Keys
+	// must not be set.
+	Group string
+
+	// If true, the connection remembers the local address packets from each
+	// peer were sent to, and WriteTo sends packets to the peer from that
+	// address. Useful on hosts with multiple addresses, when the underlying
+	// connection is bound to a wildcard address. Requires Config.Control to
+	// include ControlDst.
+	ReplyFromDst bool
+
+	// Limits the rate of packets from each remote address the connection
+	// receives. Packets claimed in excess are dropped, rather than offered to
+	// connections of lower priority.
+	RateLimit RateLimit
 }
 
 // NewConn returns a new net.PacketConn object which filters packets based
 // on the provided filter. If filter is nil, the connection will receive all
 // packets. Priority decides which connection gets the ability to claim the packet.
+// The returned connection implements Conn.
 func (d *PacketFilter) NewConn(priority int, filter Filter) net.PacketConn {
+	conn, _ := d.NewConnWithConfig(ConnConfig{
+		Priority: priority,
+		Filter:   filter,
+	})
+	return conn
+}
+
+// NewConnWithConfig returns a new net.PacketConn object with the configuration
+// provided. The returned connection implements Conn.
+func (d *PacketFilter) NewConnWithConfig(config ConnConfig) (net.PacketConn, error) {
+	if !config.OverflowPolicy.valid() {
+		return nil, errors.New("invalid overflow policy")
+	}
+	if config.BlockTimeout < 0 {
+		return nil, errors.New("negative block timeout")
+	}
+	if config.BacklogBytes < 0 {
+		return nil, errors.New("negative backlog bytes")
+	}
+	if !config.RateLimit.valid() {
+		return nil, errInvalidRateLimit
+	}
+	if config.ReplyFromDst && (d.control&ControlDst == 0 || d.oobConn == nil) {
+		return nil, errNoDstControl
+	}
+	if config.OverflowPolicy == OverflowDefault {
+		config.OverflowPolicy = d.policy
+	}
+	if config.BlockTimeout == 0 {
+		config.BlockTimeout = d.blockTime
+	}
+
 	conn := &filteredConn{
-		priority:   priority,
-		source:     d,
-		recvBuffer: make(chan messageWithError, d.backlog),
-		filter:     filter,
-		closed:     make(chan struct{}),
+		priority:      config.Priority,
+		name:          config.Name,
+		source:        d,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		recvBuffer:    make(chan messageWithError, d.backlog),
+		backlogBytes:  config.BacklogBytes,
+		policy:        config.OverflowPolicy,
+		blockTimeout:  config.BlockTimeout,
+		space:         make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+	}
+	conn.filter.Store(filterBox{config.Filter})
+	if config.ReplyFromDst {
+		conn.replies = newReplySources()
 	}
+	conn.limiter = newRateLimiter(config.RateLimit)
+
 	d.mut.Lock()
-	d.conns = append(d.conns, conn)
-	sort.Sort(filteredConnList(d.conns))
-	d.mut.Unlock()
+	defer d.mut.Unlock()
+	d.nextSeq++
+	conn.seq = d.nextSeq
+	select {
+	case <-d.closed:
+		// The filter is already closed, hand out a connection that is closed too.
+		conn.markClosed()
+	default:
+		if config.Group != "" {
+			group, ok := d.groups[config.Group]
+			if !ok {
+				return nil, errNoSuchGroup
+			}
+			if len(config.Keys) > 0 || config.Filter != nil {
+				return nil, errGroupMember
+			}
+			conn.group = group
+			conn.priority = group.priority
+		}
+		if len(config.Keys) > 0 {
+			if err := d.checkKeysLocked(conn, config.Keys); err != nil {
+				return nil, err
+			}
+			conn.keyed = true
+			conn.keys = make(map[string]struct{}, len(config.Keys))
+			for _, key := range config.Keys {
+				conn.keys[key] = struct{}{}
+			}
+		}
+		old := d.loadTable().conns
+		conns := make([]*filteredConn, len(old), len(old)+1)
+		copy(conns, old)
+		conns = append(conns, conn)
+		d.storeTableLocked(conns)
+	}
 	if d.oobConn != nil {
-		return &filteredConnObb{conn}
+		return &filteredConnObb{conn}, nil
 	}
-	return conn
+	return conn, nil
 }
 
 func (d *PacketFilter) removeConn(r *filteredConn) {
 	d.mut.Lock()
-	for i, conn := range d.conns {
-		if conn == r {
-			copy(d.conns[i:], d.conns[i+1:])
-			d.conns[len(d.conns)-1] = nil
-			d.conns = d.conns[:len(d.conns)-1]
-			break
+	old := d.loadTable().conns
+	conns := make([]*filteredConn, 0, len(old))
+	for _, conn := range old {
+		if conn != r {
+			conns = append(conns, conn)
+		} else {
+			d.retireLocked(conn)
 		}
 	}
+	d.storeTableLocked(conns)
 	d.mut.Unlock()
 }
 
+// updateConn applies a change to the given connection, and publishes a new
+// table reflecting it.
+func (d *PacketFilter) updateConn(r *filteredConn, update func() error) error {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if err := r.checkState(); err != nil {
+		return err
+	}
+	if err := update(); err != nil {
+		return err
+	}
+
+	old := d.loadTable().conns
+	conns := make([]*filteredConn, len(old))
+	copy(conns, old)
+	d.storeTableLocked(conns)
+	return nil
+}
+
+// updateKeys registers and unregisters keys of the given connection.
+func (d *PacketFilter) updateKeys(r *filteredConn, add, remove []string) error {
+	return d.updateConn(r, func() error {
+		if r.group != nil && len(add) > 0 {
+			return errGroupMember
+		}
+		if err := d.checkKeysLocked(r, add); err != nil {
+			return err
+		}
+		if r.keys == nil {
+			r.keys = make(map[string]struct{}, len(add))
+		}
+		for _, key := range add {
+			r.keys[key] = struct{}{}
+			r.keyed = true
+		}
+		for _, key := range remove {
+			delete(r.keys, key)
+		}
+		return nil
+	})
+}
+
+func (d *PacketFilter) checkKeysLocked(r *filteredConn, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if d.keyFunc == nil {
+		return errNoKeyFunc
+	}
+	table := d.loadTable()
+	for _, key := range keys {
+		if owner, ok := table.keys[key]; ok && owner != r {
+			return errKeyInUse
+		}
+	}
+	return nil
+}
+
+// storeTableLocked publishes a new table built from the given connections,
+// which it takes ownership of.
+func (d *PacketFilter) storeTableLocked(conns []*filteredConn) {
+	d.table.Store(newDispatchTable(conns, d.groups))
+}
+
+// loadTable returns the current snapshot of connections. The returned table
+// must not be modified, as it's shared with the read loop.
+func (d *PacketFilter) loadTable() *dispatchTable {
+	if table, ok := d.table.Load().(*dispatchTable); ok {
+		return table
+	}
+	return &dispatchTable{}
+}
+
 // NumberOfConns returns the number of currently active virtual connections
 func (d *PacketFilter) NumberOfConns() int {
+	return len(d.loadTable().conns)
+}
+
+// Stats returns a snapshot of the packet filter's counters, including the
+// counters of every active virtual connection.
+func (d *PacketFilter) Stats() Stats {
+	stats := Stats{
+		Dropped:     d.Dropped(),
+		Overflow:    d.Overflow(),
+		Claimed:     d.Claimed(),
+		Copied:      d.Copied(),
+		Rejected:    d.Rejected(),
+		Truncated:   d.Truncated(),
+		RateLimited: d.RateLimited(),
+		Denied:      d.Denied(),
+		QueuedBytes: int(atomic.LoadInt64(&d.queuedBytes)),
+	}
+
+	// Connections are retired while holding the mutex, so that none of them
+	// are counted twice or missed.
 	d.mut.Lock()
-	n := len(d.conns)
-	d.mut.Unlock()
-	return n
+	defer d.mut.Unlock()
+	conns := d.loadTable().conns
+	stats.Conns = make([]ConnStats, 0, len(conns))
+	for _, conn := range conns {
+		stats.Conns = append(stats.Conns, conn.statsLocked())
+	}
+	stats.Closed = make([]ConnStats, 0, len(d.retired))
+	for _, total := range d.retired {
+		stats.Closed = append(stats.Closed, *total)
+	}
+	sort.Slice(stats.Closed, func(i, j int) bool {
+		return stats.Closed[i].Name < stats.Closed[j].Name
+	})
+	return stats
+}
+
+// retireLocked adds the counters of a connection that is being removed to the
+// totals of closed connections. Should be called while holding the mutex.
+func (d *PacketFilter) retireLocked(r *filteredConn) {
+	total, ok := d.retired[r.name]
+	if !ok {
+		if d.retired == nil {
+			d.retired = make(map[string]*ConnStats)
+		}
+		total = &ConnStats{Name: r.name}
+		d.retired[r.name] = total
+	}
+	total.add(r.stats.snapshot())
 }
 
 // Dropped returns number of packets dropped due to nobody claiming them.
@@ -160,18 +697,72 @@ func (d *PacketFilter) Dropped() uint64 {
 	return atomic.LoadUint64(&d.dropped)
 }
 
+// Rejected returns number of packets dropped due to a filter returning VerdictDrop.
+func (d *PacketFilter) Rejected() uint64 {
+	return atomic.LoadUint64(&d.rejected)
+}
+
+// Truncated returns number of packets that were larger than the buffer size,
+// whether they were delivered truncated or dropped.
+func (d *PacketFilter) Truncated() uint64 {
+	return atomic.LoadUint64(&d.truncated)
+}
+
+// RateLimited returns number of packets dropped due to Config.RateLimit, or the
+// rate limit of the connection they were meant for.
+func (d *PacketFilter) RateLimited() uint64 {
+	return atomic.LoadUint64(&d.limited)
+}
+
+// Denied returns number of packets dropped due to the ACL of the packet filter.
+func (d *PacketFilter) Denied() uint64 {
+	return atomic.LoadUint64(&d.denied)
+}
+
+// SetACL atomically replaces the ACL packets are checked against before being
+// offered to any connection. A nil ACL allows all packets.
+func (d *PacketFilter) SetACL(acl *ACL) {
+	d.acl.Store(aclBox{acl})
+}
+
+// Claimed returns number of packets claimed by connections, including those
+// that have since been closed.
+func (d *PacketFilter) Claimed() uint64 {
+	return atomic.LoadUint64(&d.claimed)
+}
+
+// Copied returns number of packet copies delivered due to filters returning
+// VerdictCopy.
+func (d *PacketFilter) Copied() uint64 {
+	return atomic.LoadUint64(&d.copied)
+}
+
 // Overflow returns number of packets were dropped due to receive buffers being
-// full.
+// full, including packets evicted or timed out by the connection's overflow policy.
 func (d *PacketFilter) Overflow() uint64 {
 	return atomic.LoadUint64(&d.overflow)
 }
 
 // Start starts reading packets from the socket and forwarding them to connections.
 // Should call this after creating all the expected connections using NewConn, otherwise the packets
-// read will be dropped.
+// read will be dropped. Calling Start more than once, or after Close, has no effect.
 func (d *PacketFilter) Start() {
+	d.mut.Lock()
+	select {
+	case <-d.closed:
+		d.mut.Unlock()
+		return
+	default:
+	}
+	if d.started {
+		d.mut.Unlock()
+		return
+	}
+	d.started = true
+	d.mut.Unlock()
+
 	msgReader := d.readFrom
-	if d.ipv4Conn != nil {
+	if d.batch != nil {
 		msgReader = d.readBatch
 	} else if d.oobConn != nil {
 		msgReader = d.readMsgUdp
@@ -179,32 +770,126 @@ func (d *PacketFilter) Start() {
 	go d.loop(msgReader)
 }
 
+// Close stops the read loop, closes all virtual connections created via NewConn
+// and releases any packets still buffered for them. The underlying connection
+// is closed only if Config.CloseConn was set, otherwise its read deadline is
+// reset once the read loop has exited.
+func (d *PacketFilter) Close() error {
+	first := false
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		first = true
+	})
+	if !first {
+		return errClosed
+	}
+
+	d.mut.Lock()
+	started := d.started
+	conns := d.loadTable().conns
+	for _, conn := range conns {
+		d.retireLocked(conn)
+	}
+	d.table.Store(&dispatchTable{})
+	d.mut.Unlock()
+
+	for _, conn := range conns {
+		conn.markClosed()
+		conn.drain()
+	}
+
+	// The loop might have already exited due to an error, such as the
+	// underlying connection having been closed, in which case there is
+	// nothing to interrupt.
+	stopped := false
+	select {
+	case <-d.done:
+		stopped = true
+	default:
+	}
+
+	var err error
+	if d.closeConn {
+		err = d.conn.Close()
+		if stopped && errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+	} else if started && !stopped {
+		// Interrupt the pending read, so that the loop notices we're closed.
+		err = d.conn.SetReadDeadline(time.Unix(1, 0))
+	}
+
+	if !started {
+		close(d.done)
+		return err
+	}
+	if stopped {
+		return err
+	}
+
+	if err != nil {
+		// We have no way to interrupt the loop, it will exit on the next
+		// read that completes.
+		return err
+	}
+
+	<-d.done
+
+	if !d.closeConn {
+		err = d.conn.SetReadDeadline(time.Time{})
+	}
+	return err
+}
+
+// Err returns the non-temporary error from the underlying connection that
+// stopped the read loop, or nil if no such error has occurred. Once set, the
+// same error is returned by all reads and writes on the virtual connections.
+func (d *PacketFilter) Err() error {
+	select {
+	case <-d.failed:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+// Done returns a channel which is closed once the read loop has exited, either
+// due to Close being called, or due to a non-temporary error on the underlying
+// connection.
+func (d *PacketFilter) Done() <-chan struct{} {
+	return d.done
+}
+
 func (d *PacketFilter) readFrom() []messageWithError {
-	buf := d.bufPool.Get().([]byte)
+	buf := d.alloc.Get(d.readSize())
 	n, addr, err := d.conn.ReadFrom(buf)
+	if n < 0 {
+		n = 0
+	}
 
-	return []messageWithError{
-		{
-			Message: ipv4.Message{
-				Buffers: [][]byte{buf[:n]},
-				Addr:    addr,
-				N:       n,
-			},
-			Err: err,
-		},
+	d.results[0] = messageWithError{
+		Buf:  buf,
+		Addr: addr,
+		N:    n,
+		Err:  err,
 	}
+	return d.results[:1]
+}
+
+// batchReader reads a batch of messages, like ipv4.PacketConn.
+type batchReader interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
 }
 
 func (d *PacketFilter) readBatch() []messageWithError {
-	batch := make([]ipv4.Message, d.batchSize)
-	for i := range batch {
-		buf := d.bufPool.Get().([]byte)
-		oobBuf := d.bufPool.Get().([]byte)
-		batch[i].Buffers = [][]byte{buf}
-		batch[i].OOB = oobBuf
+	for i := range d.batch {
+		if d.batchBufs[i] == nil {
+			d.batchBufs[i] = d.alloc.Get(d.readSize())
+			d.batch[i].OOB = d.alloc.Get(d.oobSize)
+		}
 	}
 
-	n, err := d.ipv4Conn.ReadBatch(batch, 0)
+	n, err := d.batchReader.ReadBatch(d.batch, 0)
 
 	// This is entirely unexpected, but happens in the wild
 	if n < 0 && err == nil {
@@ -217,15 +902,28 @@ func (d *PacketFilter) readBatch() []messageWithError {
 		n = 1
 	}
 
-	result := make([]messageWithError, n)
+	result := d.results[:n]
 
-	for i := 0; i < n; i++ {
-		result[i].Err = err
-		result[i].Message = batch[i]
-	}
-
-	for _, msg := range batch[n:] {
-		d.returnBuffers(msg)
+	for i := range result {
+		msg := &d.batch[i]
+		if err != nil {
+			// Left over from the previous read.
+			msg.Addr = nil
+		}
+		result[i] = messageWithError{
+			Buf:   d.batchBufs[i],
+			OOB:   msg.OOB,
+			Addr:  msg.Addr,
+			N:     msg.N,
+			NN:    msg.NN,
+			Flags: msg.Flags,
+			Err:   err,
+		}
+		// The buffers now belong to the message, refill the slot on the next
+		// call. The address is kept, so that it can be reused for the next
+		// message from the same sender.
+		d.batchBufs[i] = nil
+		msg.OOB = nil
 	}
 
 	return result
@@ -234,8 +932,8 @@ func (d *PacketFilter) readBatch() []messageWithError {
 var errUnexpectedNegativeLength = errors.New("ReadMsgUDP returned a negative number of read bytes")
 
 func (d *PacketFilter) readMsgUdp() []messageWithError {
-	buf := d.bufPool.Get().([]byte)
-	oobBuf := d.bufPool.Get().([]byte)
+	buf := d.alloc.Get(d.readSize())
+	oobBuf := d.alloc.Get(d.oobSize)
 	n, oobn, flags, addr, err := d.oobConn.ReadMsgUDP(buf, oobBuf)
 
 	// This is entirely unexpected, but happens in the wild
@@ -252,72 +950,227 @@ func (d *PacketFilter) readMsgUdp() []messageWithError {
 		oobn = 0
 	}
 
-	return []messageWithError{
-		{
-			Message: ipv4.Message{
-				Buffers: [][]byte{buf[:n]},
-				OOB:     oobBuf[:oobn],
-				Addr:    addr,
-				N:       n,
-				NN:      oobn,
-				Flags:   flags,
-			},
-			Err: err,
-		},
+	d.results[0] = messageWithError{
+		Buf:   buf,
+		OOB:   oobBuf,
+		N:     n,
+		NN:    oobn,
+		Flags: flags,
+		Err:   err,
 	}
+	// Avoid storing a typed nil pointer in the interface.
+	if addr != nil {
+		d.results[0].Addr = addr
+	}
+	return d.results[:1]
 }
 
 func (d *PacketFilter) loop(msgReader func() []messageWithError) {
+	defer close(d.done)
 	for {
 		msgs := msgReader()
+		now := time.Now()
+
+		select {
+		case <-d.closed:
+			for _, msg := range msgs {
+				d.returnBuffers(msg)
+			}
+			return
+		default:
+		}
+
 		for _, msg := range msgs {
+			if msg.Err != nil && isMsgSizeError(msg.Err) {
+				// Reported instead of MSG_TRUNC on some platforms, which is
+				// not a reason to stop reading.
+				msg.Err = nil
+				msg.Flags |= msgTrunc
+			}
 			if msg.Err != nil {
+				d.returnBuffers(msg)
 				if nerr, ok := msg.Err.(net.Error); ok && nerr.Temporary() {
 					continue
 				}
-				d.mut.Lock()
-				for _, conn := range d.conns {
-					select {
-					case conn.recvBuffer <- msg.Copy(&d.bufPool):
-					default:
-						atomic.AddUint64(&d.overflow, 1)
-					}
-				}
-				d.mut.Unlock()
-				d.returnBuffers(msg.Message)
+				d.err = msg.Err
+				close(d.failed)
 				return
 			}
 
-			d.mut.Lock()
-			sent := d.sendMessageLocked(msg)
-			d.mut.Unlock()
-			if !sent {
-				atomic.AddUint64(&d.dropped, 1)
-				d.returnBuffers(msg.Message)
+			msg.ReceivedAt = now
+			// Without a remote address the packet could not be replied to.
+			if d.truncate(&msg) && (d.dropTruncated || msg.Addr == nil) {
+				d.drop(msg, DropTruncated)
+				continue
+			}
+
+			if d.gro {
+				if size := groSegmentSize(msg.OOB[:msg.NN]); size > 0 && msg.N > size {
+					d.split(msg, size)
+					continue
+				}
 			}
+
+			d.dispatch(msg)
 		}
 	}
 }
 
-func (d *PacketFilter) returnBuffers(msg ipv4.Message) {
-	for _, buf := range msg.Buffers {
-		d.bufPool.Put(buf[:d.packetSize])
+// split dispatches each segment of a coalesced datagram as a datagram of its
+// own, with a copy of the control messages.
+func (d *PacketFilter) split(msg messageWithError, segmentSize int) {
+	for offset := 0; offset < msg.N; offset += segmentSize {
+		end := offset + segmentSize
+		if end > msg.N {
+			end = msg.N
+		}
+
+		segment := messageWithError{
+			Buf:        d.alloc.Get(end - offset),
+			Addr:       msg.Addr,
+			N:          end - offset,
+			NN:         msg.NN,
+			Flags:      msg.Flags,
+			ReceivedAt: msg.ReceivedAt,
+		}
+		copy(segment.Buf, msg.Buf[offset:end])
+		if msg.NN > 0 {
+			segment.OOB = d.alloc.Get(msg.NN)
+			copy(segment.OOB, msg.OOB[:msg.NN])
+		}
+		// Only the last segment lost data if the datagram was truncated.
+		if end < msg.N {
+			segment.Flags &^= msgTrunc
+		}
+
+		d.dispatch(segment)
+	}
+	d.returnBuffers(msg)
+}
+
+// readSize returns the size of read buffers. The extra byte tells truncated
+// datagrams apart on read paths which do not report MSG_TRUNC.
+func (d *PacketFilter) readSize() int {
+	return d.packetSize + 1
+}
+
+// truncate marks and counts the message if it was larger than the buffer size,
+// cutting it down to the buffer size.
+func (d *PacketFilter) truncate(msg *messageWithError) bool {
+	if msg.N <= d.packetSize && msg.Flags&msgTrunc == 0 {
+		return false
+	}
+	if msg.N > d.packetSize {
+		msg.N = d.packetSize
+	}
+	msg.Flags |= msgTrunc
+	atomic.AddUint64(&d.truncated, 1)
+	return true
+}
+
+// reserve accounts for a message of the given size being queued for the
+// connection, unless that would exceed one of the byte limits. Only the read
+// loop queues messages, so the check and the update need not be atomic.
+func (d *PacketFilter) reserve(r *filteredConn, size int) overflowReason {
+	if r.backlogBytes > 0 && atomic.LoadInt64(&r.queuedBytes)+int64(size) > int64(r.backlogBytes) {
+		return overflowConnBytes
+	}
+	if d.maxBufferedBytes > 0 && atomic.LoadInt64(&d.queuedBytes)+int64(size) > int64(d.maxBufferedBytes) {
+		return overflowMemory
+	}
+	atomic.AddInt64(&r.queuedBytes, int64(size))
+	atomic.AddInt64(&d.queuedBytes, int64(size))
+	return overflowNone
+}
+
+func (d *PacketFilter) release(r *filteredConn, size int) {
+	atomic.AddInt64(&r.queuedBytes, -int64(size))
+	atomic.AddInt64(&d.queuedBytes, -int64(size))
+}
+
+func (d *PacketFilter) returnBuffers(msg messageWithError) {
+	if msg.Buf != nil {
+		d.alloc.Put(msg.Buf)
 	}
 	if msg.OOB != nil {
-		d.bufPool.Put(msg.OOB[:d.packetSize])
+		d.alloc.Put(msg.OOB)
 	}
 }
 
-func (d *PacketFilter) sendMessageLocked(msg messageWithError) bool {
-	for _, conn := range d.conns {
-		if conn.filter == nil || conn.filter.ClaimIncoming(msg.Buffers[0], msg.Addr) {
-			select {
-			case conn.recvBuffer <- msg:
-			default:
-				atomic.AddUint64(&d.overflow, 1)
+// compact moves a message small enough into buffers sized to fit it, so that
+// memory held by queued messages tracks their actual size.
+func (d *PacketFilter) compact(msg messageWithError) messageWithError {
+	if d.compactThreshold == 0 || msg.N > d.compactThreshold || cap(msg.Buf) < d.packetSize {
+		return msg
+	}
+	small := msg.Copy(d.alloc)
+	d.returnBuffers(msg)
+	return small
+}
+
+// dispatch delivers the message to the connection registered for its key, or
+// otherwise offers it to connections in order of priority, dropping it if
+// nobody claims it. The connection snapshot is used without locking, so
+// filters are free to take their time.
+func (d *PacketFilter) dispatch(msg messageWithError) {
+	if acl := d.acl.Load().(aclBox).ACL; acl != nil && !acl.allowedAddr(msg.Addr) {
+		atomic.AddUint64(&d.denied, 1)
+		d.drop(msg, DropDenied)
+		return
+	}
+	if d.limiter != nil && !d.limiter.allow(msg.Addr, msg.ReceivedAt) {
+		atomic.AddUint64(&d.limited, 1)
+		d.drop(msg, DropRateLimited)
+		return
+	}
+
+	table := d.loadTable()
+	if conn := table.lookup(d.keyFunc, msg); conn != nil {
+		if conn.rateLimited(&msg) {
+			d.drop(msg, DropRateLimited)
+			return
+		}
+		atomic.AddUint64(&d.claimed, 1)
+		conn.stats.claimed(msg.N)
+		conn.enqueue(msg)
+		return
+	}
+	for i := range table.slots {
+		verdict, conn := table.slots[i].verdict(&msg)
+		switch verdict {
+		case VerdictClaim:
+			if conn.rateLimited(&msg) {
+				d.drop(msg, DropRateLimited)
+				return
+			}
+			atomic.AddUint64(&d.claimed, 1)
+			conn.stats.claimed(msg.N)
+			conn.enqueue(msg)
+			return
+		case VerdictCopy:
+			if conn.rateLimited(&msg) {
+				continue
+			}
+			atomic.AddUint64(&d.copied, 1)
+			conn.stats.copied(msg.N)
+			conn.enqueue(msg.Copy(d.alloc))
+		case VerdictDrop:
+			atomic.AddUint64(&d.rejected, 1)
+			if conn != nil {
+				conn.stats.rejected(msg.N)
 			}
-			return true
+			d.drop(msg, DropRejected)
+			return
 		}
 	}
-	return false
+	atomic.AddUint64(&d.dropped, 1)
+	d.drop(msg, DropUnclaimed)
+}
+
+// drop passes the message to the unclaimed handler, if any, and recycles it.
+func (d *PacketFilter) drop(msg messageWithError, reason DropReason) {
+	if d.unclaimed != nil {
+		d.unclaimed(msg.Data(), msg.OOB[:msg.NN], msg.Addr, reason)
+	}
+	d.returnBuffers(msg)
 }
@@ -0,0 +1,1438 @@
+package pfilter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+func newTestPair(t *testing.T) (net.PacketConn, net.Conn) {
+	t.Helper()
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	client, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	return server, client
+}
+
+func unwrapConn(conn net.PacketConn) *filteredConn {
+	if obb, ok := conn.(*filteredConnObb); ok {
+		return obb.filteredConn
+	}
+	return conn.(*filteredConn)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClose(t *testing.T) {
+	server, client := newTestPair(t)
+
+	pf := NewPacketFilter(server)
+	conn := pf.NewConn(10, nil)
+	pf.Start()
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(unwrapConn(conn).recvBuffer) == 1 })
+
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pf.Done():
+	default:
+		t.Fatal("read loop still running after close")
+	}
+	if err := pf.Close(); err != errClosed {
+		t.Error("expected second close to fail, got", err)
+	}
+	if n := pf.NumberOfConns(); n != 0 {
+		t.Error("unexpected number of conns", n)
+	}
+	if n := len(unwrapConn(conn).recvBuffer); n != 0 {
+		t.Error("queued packets not released", n)
+	}
+	if _, _, err := conn.ReadFrom(make([]byte, 10)); err != errClosed {
+		t.Error("expected read on closed conn to fail, got", err)
+	}
+	if late := pf.NewConn(10, nil); late.Close() != errClosed {
+		t.Error("conn created after close is not closed")
+	}
+
+	// The underlying connection should still be usable.
+	if _, err := client.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "world" {
+		t.Errorf("unexpected read %q", buf[:n])
+	}
+}
+
+func TestCloseConn(t *testing.T) {
+	server, _ := newTestPair(t)
+
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:       server,
+		BufferSize: 1500,
+		Backlog:    256,
+		CloseConn:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf.NewConn(10, nil)
+	pf.Start()
+
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-pf.Done()
+	if _, _, err := server.ReadFrom(make([]byte, 10)); err == nil {
+		t.Error("expected underlying connection to be closed")
+	}
+}
+
+func TestCloseAfterConnClosed(t *testing.T) {
+	for _, closeConn := range []bool{false, true} {
+		server, _ := newTestPair(t)
+
+		pf, err := NewPacketFilterWithConfig(Config{
+			Conn:       server,
+			BufferSize: 1500,
+			Backlog:    256,
+			CloseConn:  closeConn,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pf.NewConn(10, nil)
+		pf.Start()
+
+		server.Close()
+		<-pf.Done()
+
+		if err := pf.Close(); err != nil {
+			t.Errorf("close with CloseConn %v failed: %v", closeConn, err)
+		}
+	}
+}
+
+type failingConn struct {
+	net.PacketConn
+	fail chan error
+}
+
+func (c *failingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return 0, nil, <-c.fail
+}
+
+func TestStickyError(t *testing.T) {
+	server, _ := newTestPair(t)
+	conn := &failingConn{PacketConn: server, fail: make(chan error, 1)}
+
+	pf := NewPacketFilter(conn)
+	vconn := pf.NewConn(10, nil)
+	pf.Start()
+
+	if err := pf.Err(); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := vconn.ReadFrom(make([]byte, 10))
+		readErr <- err
+	}()
+
+	expected := &netError{msg: "broken"}
+	conn.fail <- expected
+
+	select {
+	case err := <-readErr:
+		if err != expected {
+			t.Error("unexpected error from pending read", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending read did not return")
+	}
+
+	<-pf.Done()
+
+	if err := pf.Err(); err != expected {
+		t.Error("unexpected error", err)
+	}
+	if _, _, err := vconn.ReadFrom(make([]byte, 10)); err != expected {
+		t.Error("unexpected error from read", err)
+	}
+	if _, err := vconn.WriteTo([]byte("hello"), server.LocalAddr()); err != expected {
+		t.Error("unexpected error from write", err)
+	}
+	if _, _, err := pf.NewConn(10, nil).ReadFrom(make([]byte, 10)); err != expected {
+		t.Error("unexpected error from read on new conn", err)
+	}
+}
+
+type prefixFilter string
+
+func (f prefixFilter) Outgoing([]byte, net.Addr) {}
+
+func (f prefixFilter) ClaimIncoming(b []byte, _ net.Addr) bool {
+	return len(b) >= len(f) && string(b[:len(f)]) == string(f)
+}
+
+func TestStats(t *testing.T) {
+	server, client := newTestPair(t)
+
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:       server,
+		BufferSize: 1500,
+		Backlog:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stun := pf.NewConn(5, prefixFilter("stun")).(Conn)
+	other := pf.NewConn(10, nil).(Conn)
+	pf.Start()
+	defer pf.Close()
+
+	for _, msg := range []string{"stun1", "stun2", "other"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool {
+		return stun.Stats().PacketsClaimed == 2 && other.Stats().PacketsClaimed == 1
+	})
+
+	if _, _, err := stun.ReadFrom(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.WriteTo([]byte("reply"), client.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := stun.Stats()
+	if stats.Priority != 5 || stats.BytesClaimed != 10 || stats.PacketsDelivered != 1 ||
+		stats.BytesDelivered != 5 || stats.PacketsOverflowed != 1 || stats.BytesOverflowed != 5 {
+		t.Errorf("unexpected stun stats %+v", stats)
+	}
+	if stats.LastActivity.IsZero() {
+		t.Error("last activity not recorded")
+	}
+	stats = other.Stats()
+	if stats.PacketsWritten != 1 || stats.BytesWritten != 5 || stats.PacketsDelivered != 0 {
+		t.Errorf("unexpected other stats %+v", stats)
+	}
+
+	all := pf.Stats()
+	if all.Overflow != 1 || len(all.Conns) != 2 || all.Conns[0].Priority != 5 || all.Conns[1].Priority != 10 {
+		t.Errorf("unexpected filter stats %+v", all)
+	}
+
+	// Counters of closed connections are kept.
+	if err := stun.Close(); err != nil {
+		t.Fatal(err)
+	}
+	all = pf.Stats()
+	if all.Claimed != 3 || len(all.Conns) != 1 || len(all.Closed) != 1 ||
+		all.Closed[0].PacketsClaimed != 2 || all.Closed[0].BytesDelivered != 5 {
+		t.Errorf("unexpected filter stats after close %+v", all)
+	}
+}
+
+func testMessage(d *PacketFilter, data string) messageWithError {
+	buf := d.alloc.Get(d.packetSize)
+	n := copy(buf, data)
+	return messageWithError{
+		Buf:  buf,
+		Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+		N:    n,
+	}
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	server, _ := newTestPair(t)
+
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:         server,
+		BufferSize:   1500,
+		Backlog:      2,
+		BlockTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	newConn := func(policy OverflowPolicy) *filteredConn {
+		conn, err := pf.NewConnWithConfig(ConnConfig{OverflowPolicy: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return unwrapConn(conn)
+	}
+	read := func(conn *filteredConn) string {
+		buf := make([]byte, 10)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	newest := newConn(OverflowDefault)
+	oldest := newConn(OverflowDropOldest)
+	block := newConn(OverflowBlock)
+	for _, conn := range []*filteredConn{newest, oldest, block} {
+		for _, data := range []string{"a", "b", "c"} {
+			conn.enqueue(testMessage(pf, data))
+		}
+	}
+
+	if got := read(newest) + read(newest); got != "ab" {
+		t.Error("drop newest: unexpected packets", got)
+	}
+	if stats := newest.Stats(); stats.PacketsOverflowed != 1 {
+		t.Errorf("drop newest: unexpected stats %+v", stats)
+	}
+
+	if got := read(oldest) + read(oldest); got != "bc" {
+		t.Error("drop oldest: unexpected packets", got)
+	}
+	if stats := oldest.Stats(); stats.PacketsEvicted != 1 || stats.PacketsOverflowed != 0 {
+		t.Errorf("drop oldest: unexpected stats %+v", stats)
+	}
+
+	if got := read(block) + read(block); got != "ab" {
+		t.Error("block: unexpected packets", got)
+	}
+	if stats := block.Stats(); stats.Blocked != 1 || stats.PacketsTimedOut != 1 {
+		t.Errorf("block: unexpected stats %+v", stats)
+	}
+
+	// Without a timeout, a blocked delivery waits for the reader to catch up.
+	lossless := newConn(OverflowBlock)
+	lossless.blockTimeout = 0
+	lossless.enqueue(testMessage(pf, "x"))
+	lossless.enqueue(testMessage(pf, "y"))
+	readErr := make(chan error, 1)
+	go func() {
+		// Only make room once the delivery is blocked.
+		for lossless.Stats().Blocked == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		_, _, err := lossless.ReadFrom(make([]byte, 10))
+		readErr <- err
+	}()
+	lossless.enqueue(testMessage(pf, "z"))
+	if err := <-readErr; err != nil {
+		t.Fatal(err)
+	}
+	if stats := lossless.Stats(); stats.Blocked != 1 || stats.PacketsTimedOut != 0 {
+		t.Errorf("block: unexpected stats %+v", stats)
+	}
+	if got := read(lossless) + read(lossless); got != "yz" {
+		t.Error("block: unexpected packets", got)
+	}
+
+	if pf.Overflow() != 3 {
+		t.Error("unexpected overflow count", pf.Overflow())
+	}
+}
+
+func TestByteLimits(t *testing.T) {
+	server, _ := newTestPair(t)
+
+	// Compacted packets hold the smallest buffer size class, 64 bytes, which is
+	// what they account for.
+	const unit = 64
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:             server,
+		BufferSize:       1500,
+		Backlog:          256,
+		MaxBufferedBytes: 4 * unit,
+		CompactThreshold: unit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	newConn := func(cfg ConnConfig) *filteredConn {
+		conn, err := pf.NewConnWithConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return unwrapConn(conn)
+	}
+
+	small := newConn(ConnConfig{BacklogBytes: 2 * unit})
+	fresh := newConn(ConnConfig{BacklogBytes: 2 * unit, OverflowPolicy: OverflowDropOldest})
+	other := newConn(ConnConfig{})
+	large := newConn(ConnConfig{BacklogBytes: 1000})
+
+	for _, data := range []string{"ab", "cd", "e"} {
+		small.enqueue(testMessage(pf, data))
+		fresh.enqueue(testMessage(pf, data))
+	}
+	if stats := small.Stats(); stats.QueueBytes != 2*unit || stats.PacketsByteLimited != 1 || stats.BytesByteLimited != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats := fresh.Stats(); stats.QueueBytes != 2*unit || stats.PacketsEvicted != 1 || stats.PacketsByteLimited != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Packets which are not compacted account for the whole read buffer.
+	large.enqueue(testMessage(pf, strings.Repeat("x", 2*unit)))
+	if stats := large.Stats(); stats.QueueBytes != 0 || stats.PacketsByteLimited != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// All of the global limit is used.
+	other.enqueue(testMessage(pf, "fg"))
+	if stats := other.Stats(); stats.QueueBytes != 0 || stats.PacketsMemoryLimited != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	if _, _, err := small.ReadFrom(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	other.enqueue(testMessage(pf, "fg"))
+	if stats := other.Stats(); stats.QueueBytes != unit || stats.PacketsMemoryLimited != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats := pf.Stats(); stats.QueuedBytes != 4*unit || stats.Overflow != 4 {
+		t.Errorf("unexpected filter stats %+v", stats)
+	}
+}
+
+type blockingFilter struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingFilter) Outgoing([]byte, net.Addr) {}
+
+func (f *blockingFilter) ClaimIncoming([]byte, net.Addr) bool {
+	close(f.entered)
+	<-f.release
+	return true
+}
+
+func TestSlowFilterDoesNotBlockManagement(t *testing.T) {
+	server, client := newTestPair(t)
+
+	pf := NewPacketFilter(server)
+	filter := &blockingFilter{entered: make(chan struct{}), release: make(chan struct{})}
+	slow := pf.NewConn(10, filter)
+	pf.Start()
+	defer pf.Close()
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	<-filter.entered
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn := pf.NewConn(5, nil)
+		if n := pf.NumberOfConns(); n != 2 {
+			t.Error("unexpected number of conns", n)
+		}
+		_ = conn.Close()
+		_ = pf.Stats()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection management blocked by filter")
+	}
+	close(filter.release)
+
+	_ = slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := slow.ReadFrom(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyedDispatch(t *testing.T) {
+	server, _ := newTestPair(t)
+
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:       server,
+		BufferSize: 1500,
+		Backlog:    256,
+		KeyFunc:    ByteRangeKey(0, 2),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	newConn := func(cfg ConnConfig) Conn {
+		conn, err := pf.NewConnWithConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn.(Conn)
+	}
+	a := newConn(ConnConfig{Priority: 1, Keys: []string{"aa"}})
+	b := newConn(ConnConfig{Priority: 1})
+	fallback := newConn(ConnConfig{Priority: 10})
+
+	if err := b.AddKey("bb"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddKey("aa"); err != errKeyInUse {
+		t.Error("expected key conflict, got", err)
+	}
+	if _, err := pf.NewConnWithConfig(ConnConfig{Keys: []string{"bb"}}); err != errKeyInUse {
+		t.Error("expected key conflict, got", err)
+	}
+
+	for _, data := range []string{"aa1", "bb1", "cc1", "x"} {
+		pf.dispatch(testMessage(pf, data))
+	}
+	if err := a.RemoveKey("aa"); err != nil {
+		t.Fatal(err)
+	}
+	pf.dispatch(testMessage(pf, "aa2"))
+
+	if got := readAll(a); got != "aa1 " {
+		t.Errorf("unexpected packets %q", got)
+	}
+	if got := readAll(b); got != "bb1 " {
+		t.Errorf("unexpected packets %q", got)
+	}
+	if got := readAll(fallback); got != "cc1 x aa2 " {
+		t.Errorf("unexpected packets %q", got)
+	}
+
+	other := NewPacketFilter(server)
+	if err := other.NewConn(10, nil).(Conn).AddKey("aa"); err != errNoKeyFunc {
+		t.Error("expected missing key function error, got", err)
+	}
+}
+
+type verdictFunc func([]byte) Verdict
+
+func (f verdictFunc) Outgoing([]byte, net.Addr) {}
+
+func (f verdictFunc) ClaimIncoming(b []byte, _ net.Addr) bool {
+	panic("should not be called")
+}
+
+func (f verdictFunc) Verdict(b []byte, _ net.Addr) Verdict {
+	return f(b)
+}
+
+func readAll(conn net.PacketConn) string {
+	var result string
+	buf := make([]byte, 10)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return result
+		}
+		result += string(buf[:n]) + " "
+	}
+}
+
+func TestVerdicts(t *testing.T) {
+	server, _ := newTestPair(t)
+
+	pf := NewPacketFilter(server)
+	defer pf.Close()
+
+	monitor := pf.NewConn(1, verdictFunc(func([]byte) Verdict { return VerdictCopy }))
+	pf.NewConn(2, verdictFunc(func(b []byte) Verdict {
+		if string(b) == "bad" {
+			return VerdictDrop
+		}
+		return VerdictPass
+	}))
+	main := pf.NewConn(3, nil)
+
+	for _, data := range []string{"a", "bad", "b"} {
+		pf.dispatch(testMessage(pf, data))
+	}
+
+	if got := readAll(monitor); got != "a bad b " {
+		t.Errorf("unexpected packets %q", got)
+	}
+	if got := readAll(main); got != "a b " {
+		t.Errorf("unexpected packets %q", got)
+	}
+	if pf.Copied() != 3 || pf.Rejected() != 1 || pf.Dropped() != 0 {
+		t.Error("unexpected counters", pf.Copied(), pf.Rejected(), pf.Dropped())
+	}
+	if stats := monitor.(Conn).Stats(); stats.PacketsCopied != 3 || stats.PacketsClaimed != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestUnclaimedHandler(t *testing.T) {
+	server, _ := newTestPair(t)
+
+	var dropped []string
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:       server,
+		BufferSize: 1500,
+		Backlog:    256,
+		UnclaimedHandler: func(data, oob []byte, addr net.Addr, reason DropReason) {
+			dropped = append(dropped, string(data)+":"+reason.String())
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	pf.NewConn(1, verdictFunc(func(b []byte) Verdict {
+		if string(b) == "bad" {
+			return VerdictDrop
+		}
+		return VerdictPass
+	}))
+	stun := pf.NewConn(2, prefixFilter("stun"))
+
+	for _, data := range []string{"bad", "stun", "other"} {
+		pf.dispatch(testMessage(pf, data))
+	}
+
+	if got := readAll(stun); got != "stun " {
+		t.Errorf("unexpected packets %q", got)
+	}
+	if len(dropped) != 2 || dropped[0] != "bad:rejected" || dropped[1] != "other:unclaimed" {
+		t.Error("unexpected dropped packets", dropped)
+	}
+	if pf.Rejected() != 1 || pf.Dropped() != 1 {
+		t.Error("unexpected counters", pf.Rejected(), pf.Dropped())
+	}
+}
+
+func TestStableOrderAndReprioritisation(t *testing.T) {
+	server, _ := newTestPair(t)
+
+	pf := NewPacketFilter(server)
+	defer pf.Close()
+
+	var conns []Conn
+	for i := 0; i < 10; i++ {
+		conns = append(conns, pf.NewConn(10, nil).(Conn))
+	}
+
+	pf.dispatch(testMessage(pf, "a"))
+	if got := readAll(conns[0]); got != "a " {
+		t.Errorf("first registered connection got %q", got)
+	}
+
+	last := conns[len(conns)-1]
+	pf.dispatch(testMessage(pf, "b"))
+	if err := last.SetPriority(5); err != nil {
+		t.Fatal(err)
+	}
+	pf.dispatch(testMessage(pf, "c"))
+	if err := last.SetFilter(prefixFilter("x")); err != nil {
+		t.Fatal(err)
+	}
+	pf.dispatch(testMessage(pf, "d"))
+	pf.dispatch(testMessage(pf, "xe"))
+
+	if got := readAll(last); got != "c xe " {
+		t.Errorf("reprioritised connection got %q", got)
+	}
+	if got := readAll(conns[0]); got != "b d " {
+		t.Errorf("first registered connection got %q", got)
+	}
+	if stats := pf.Stats(); stats.Conns[0].Priority != 5 {
+		t.Errorf("unexpected stats %+v", stats.Conns[0])
+	}
+
+	_ = last.Close()
+	if err := last.SetPriority(1); err != errClosed {
+		t.Error("expected error on closed connection, got", err)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	server, _ := newTestPair(t)
+
+	pf := NewPacketFilter(server)
+	defer pf.Close()
+
+	for _, cfg := range []GroupConfig{
+		{Name: "rr", Priority: 1, Filter: prefixFilter("r"), Balance: BalanceRoundRobin},
+		{Name: "least", Priority: 1, Filter: prefixFilter("l"), Balance: BalanceLeastQueued},
+		{Name: "hash", Priority: 1, Filter: prefixFilter("h"), Balance: BalanceSourceHash},
+		{Name: "empty", Priority: 0},
+	} {
+		if err := pf.NewGroup(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pf.NewGroup(GroupConfig{Name: "rr"}); err != errGroupExists {
+		t.Error("expected duplicate group error, got", err)
+	}
+	if _, err := pf.NewConnWithConfig(ConnConfig{Group: "missing"}); err != errNoSuchGroup {
+		t.Error("expected missing group error, got", err)
+	}
+
+	members := make(map[string][]Conn)
+	for _, group := range []string{"rr", "least", "hash"} {
+		for i := 0; i < 3; i++ {
+			conn, err := pf.NewConnWithConfig(ConnConfig{Group: group})
+			if err != nil {
+				t.Fatal(err)
+			}
+			members[group] = append(members[group], conn.(Conn))
+		}
+	}
+	fallback := pf.NewConn(10, nil)
+
+	if err := members["rr"][0].SetFilter(nil); err != errGroupMember {
+		t.Error("expected group member error, got", err)
+	}
+
+	for i := 0; i < 6; i++ {
+		pf.dispatch(testMessage(pf, "r"))
+	}
+	for _, member := range members["rr"] {
+		if got := readAll(member); got != "r r " {
+			t.Errorf("round robin member got %q", got)
+		}
+	}
+
+	// Every member but the last has something queued already.
+	for _, member := range members["least"][:2] {
+		unwrapConn(member).enqueue(testMessage(pf, "x"))
+	}
+	pf.dispatch(testMessage(pf, "l"))
+	if got := readAll(members["least"][2]); got != "l " {
+		t.Errorf("least queued member got %q", got)
+	}
+
+	for i := 0; i < 5; i++ {
+		msg := testMessage(pf, "h")
+		msg.Addr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000 + i%2}
+		pf.dispatch(msg)
+	}
+	// Two sources, so at most two members should have received packets.
+	receivers, total := 0, 0
+	for _, member := range members["hash"] {
+		if got := readAll(member); got != "" {
+			receivers++
+			total += len(got) / 2
+		}
+	}
+	if receivers > 2 || total != 5 {
+		t.Error("source hash spread packets unexpectedly", receivers, total)
+	}
+
+	pf.dispatch(testMessage(pf, "other"))
+	if got := readAll(fallback); got != "other " {
+		t.Errorf("fallback got %q", got)
+	}
+}
+
+func TestBatchRead(t *testing.T) {
+	server, client := newTestPair(t)
+
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:       server,
+		BufferSize: 1500,
+		Backlog:    16,
+		BatchSize:  4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	conn := pf.NewConn(1, prefixFilter("a"))
+	other := pf.NewConn(2, nil)
+	pf.Start()
+
+	// More packets than fit a batch, so that slots get refilled.
+	var want []string
+	for i := 0; i < 10; i++ {
+		data := fmt.Sprintf("a%d", i)
+		want = append(want, data)
+		if _, err := client.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write([]byte("b")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ms := make([]ipv4.Message, 3)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, 10)}
+	}
+	var got []string
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(got) < len(want) {
+		n, err := conn.(Conn).ReadBatch(ms, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range ms[:n] {
+			if msg.Addr.String() != client.LocalAddr().String() {
+				t.Errorf("unexpected address %s", msg.Addr)
+			}
+			got = append(got, string(msg.Buffers[0][:msg.N]))
+		}
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, expected %v", got, want)
+	}
+
+	waitFor(t, func() bool { return unwrapConn(other).Stats().PacketsClaimed == 10 })
+}
+
+func TestSizeClassAllocator(t *testing.T) {
+	alloc := NewSizeClassAllocator(1, 1500, 64, 256)
+
+	buf := alloc.Get(100)
+	if len(buf) != 100 || cap(buf) != 256 {
+		t.Fatalf("unexpected buffer len %d cap %d", len(buf), cap(buf))
+	}
+	alloc.Put(buf)
+	if reused := alloc.Get(200); &reused[:1][0] != &buf[:1][0] {
+		t.Error("buffer was not reused")
+	}
+
+	if buf := alloc.Get(2000); len(buf) != 2000 {
+		t.Errorf("unexpected oversized buffer len %d", len(buf))
+	}
+	// Foreign buffers are ignored.
+	alloc.Put(make([]byte, 100))
+}
+
+func TestCompact(t *testing.T) {
+	server, _ := newTestPair(t)
+
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:             server,
+		BufferSize:       1500,
+		Backlog:          16,
+		CompactThreshold: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	conn := unwrapConn(pf.NewConn(1, nil))
+	conn.enqueue(testMessage(pf, "small"))
+	conn.enqueue(testMessage(pf, strings.Repeat("x", 200)))
+
+	small := <-conn.recvBuffer
+	if cap(small.Buf) != 64 || string(small.Data()) != "small" {
+		t.Errorf("small packet was not compacted, cap %d data %q", cap(small.Buf), small.Data())
+	}
+	large := <-conn.recvBuffer
+	if cap(large.Buf) != 1501 || large.N != 200 {
+		t.Errorf("large packet was compacted, cap %d", cap(large.Buf))
+	}
+	// Both still count as queued, accounting for the buffers they hold.
+	if got := pf.Stats().QueuedBytes; got != 64+1501 {
+		t.Errorf("unexpected queued bytes %d", got)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	for _, batchSize := range []int{0, 2} {
+		t.Run(fmt.Sprintf("batch%d", batchSize), func(t *testing.T) {
+			server, client := newTestPair(t)
+
+			pf, err := NewPacketFilterWithConfig(Config{
+				Conn:       server,
+				BufferSize: 10,
+				Backlog:    16,
+				BatchSize:  batchSize,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pf.Close()
+
+			conn := pf.NewConn(1, nil)
+			pf.Start()
+
+			for _, data := range []string{"0123456789", "0123456789abc"} {
+				if _, err := client.Write([]byte(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 20)
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil || string(buf[:n]) != "0123456789" {
+				t.Errorf("unexpected read %q, %v", buf[:n], err)
+			}
+
+			if batchSize > 0 {
+				ms := []ipv4.Message{{Buffers: [][]byte{buf}}}
+				n, err := unwrapConn(conn).ReadBatch(ms, 0)
+				if err != nil || n != 1 || string(buf[:ms[0].N]) != "0123456789" || ms[0].Flags&msgTrunc == 0 {
+					t.Errorf("unexpected batch read %q, flags %x, %v", buf[:ms[0].N], ms[0].Flags, err)
+				}
+			} else {
+				n, _, err = conn.ReadFrom(buf)
+				if err != errTruncated || string(buf[:n]) != "0123456789" {
+					t.Errorf("unexpected read %q, %v", buf[:n], err)
+				}
+			}
+
+			if pf.Truncated() != 1 {
+				t.Errorf("unexpected truncated count %d", pf.Truncated())
+			}
+		})
+	}
+}
+
+func TestDropTruncated(t *testing.T) {
+	server, client := newTestPair(t)
+
+	reasons := make(chan DropReason, 1)
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:          server,
+		BufferSize:    10,
+		Backlog:       16,
+		DropTruncated: true,
+		UnclaimedHandler: func(data, oob []byte, addr net.Addr, reason DropReason) {
+			reasons <- reason
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	conn := pf.NewConn(1, nil)
+	pf.Start()
+
+	for _, data := range []string{"0123456789abc", "ok"} {
+		if _, err := client.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 20)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ok" {
+		t.Errorf("unexpected read %q, %v", buf[:n], err)
+	}
+	if reason := <-reasons; reason != DropTruncated {
+		t.Errorf("unexpected drop reason %v", reason)
+	}
+	if pf.Truncated() != 1 || pf.Dropped() != 0 {
+		t.Errorf("unexpected counters, truncated %d, dropped %d", pf.Truncated(), pf.Dropped())
+	}
+}
+
+func TestReadFromControl(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("control messages are only supported on linux")
+	}
+
+	server, client := newTestPair(t)
+
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:       server,
+		BufferSize: 1500,
+		Backlog:    16,
+		Control:    ControlDst | ControlInterface | ControlHopLimit | ControlTrafficClass | ControlTimestamp,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	conn := pf.NewConn(1, nil).(Conn)
+	pf.Start()
+
+	// ECT(0)
+	if err := ipv4.NewConn(client).SetTOS(0x02); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	n, cm, _, err := conn.ReadFromControl(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("unexpected read %q, %v", buf[:n], err)
+	}
+	if cm == nil {
+		t.Fatal("no control message")
+	}
+	if !cm.Dst.Equal(net.IPv4(127, 0, 0, 1)) || cm.IfIndex == 0 || cm.HopLimit == 0 || cm.ECN() != 0x02 {
+		t.Errorf("unexpected control message %+v", cm)
+	}
+	if cm.Timestamp.Before(before.Add(-time.Second)) || cm.Timestamp.After(time.Now()) {
+		t.Errorf("unexpected timestamp %v", cm.Timestamp)
+	}
+}
+
+type inspectFunc func(*Packet) Verdict
+
+func (f inspectFunc) Outgoing([]byte, net.Addr) {}
+
+func (f inspectFunc) ClaimIncoming([]byte, net.Addr) bool {
+	panic("should not be called")
+}
+
+func (f inspectFunc) Verdict([]byte, net.Addr) Verdict {
+	panic("should not be called")
+}
+
+func (f inspectFunc) Inspect(p *Packet) Verdict {
+	return f(p)
+}
+
+func TestContextFilter(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("control messages are only supported on linux")
+	}
+
+	server, client := newTestPair(t)
+
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:       server,
+		BufferSize: 1500,
+		Backlog:    16,
+		Control:    ControlDst | ControlTrafficClass,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	packets := make(chan Packet, 1)
+	// Routes by ECN codepoint, which is not visible to plain filters.
+	ect := pf.NewConn(1, inspectFunc(func(p *Packet) Verdict {
+		if p.Control == nil || !p.Control.Dst.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("unexpected control message %+v", p.Control)
+			return VerdictPass
+		}
+		packets <- Packet{Data: append([]byte(nil), p.Data...), Addr: p.Addr, ReceivedAt: p.ReceivedAt}
+		if p.Control.ECN() != 0 {
+			return VerdictClaim
+		}
+		return VerdictPass
+	}))
+	other := pf.NewConn(2, nil)
+	pf.Start()
+
+	before := time.Now()
+	if _, err := client.Write([]byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	p := <-packets
+	if string(p.Data) != "plain" || p.Addr.String() != client.LocalAddr().String() || p.ReceivedAt.Before(before) {
+		t.Errorf("unexpected packet %+v", p)
+	}
+	if err := ipv4.NewConn(client).SetTOS(0x02); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("ect")); err != nil {
+		t.Fatal(err)
+	}
+	<-packets
+
+	if got := readAll(ect); got != "ect " {
+		t.Errorf("ect conn got %q", got)
+	}
+	if got := readAll(other); got != "plain " {
+		t.Errorf("other conn got %q", got)
+	}
+}
+
+func TestReplyFromDst(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("control messages are only supported on linux")
+	}
+
+	server, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:       server,
+		BufferSize: 1500,
+		Backlog:    16,
+		Control:    ControlDst,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	plain, err := NewPacketFilter(client).NewConnWithConfig(ConnConfig{ReplyFromDst: true})
+	if err != errNoDstControl || plain != nil {
+		t.Error("expected missing control flags to fail, got", err)
+	}
+
+	conn, err := pf.NewConnWithConfig(ConnConfig{ReplyFromDst: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf.Start()
+
+	// Any address in 127.0.0.0/8 reaches the wildcard socket via loopback.
+	port := server.LocalAddr().(*net.UDPAddr).Port
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port}
+	if _, err := client.WriteTo([]byte("ping"), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	_, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo([]byte("pong"), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" || from.String() != dst.String() {
+		t.Errorf("unexpected reply %q from %s, expected it from %s", buf[:n], from, dst)
+	}
+}
+
+type outgoingFilter struct {
+	mut  sync.Mutex
+	sent []string
+}
+
+func (f *outgoingFilter) Outgoing(b []byte, _ net.Addr) {
+	f.mut.Lock()
+	f.sent = append(f.sent, string(b))
+	f.mut.Unlock()
+}
+
+func (f *outgoingFilter) ClaimIncoming([]byte, net.Addr) bool {
+	return true
+}
+
+func TestWriteBatch(t *testing.T) {
+	for _, wrap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wrapped=%v", wrap), func(t *testing.T) {
+			server, client := newTestPair(t)
+
+			var conn net.PacketConn = server
+			if wrap {
+				// Hides the UDP connection, forcing the fallback.
+				conn = struct{ net.PacketConn }{server}
+			}
+			pf := NewPacketFilter(conn)
+			defer pf.Close()
+
+			filter := &outgoingFilter{}
+			vconn := pf.NewConn(1, filter).(Conn)
+
+			ms := make([]ipv4.Message, 3)
+			for i := range ms {
+				ms[i].Buffers = [][]byte{[]byte(fmt.Sprintf("msg%d", i))}
+				ms[i].Addr = client.LocalAddr()
+			}
+			n, err := vconn.WriteBatch(ms, 0)
+			if err != nil || n != len(ms) {
+				t.Fatalf("wrote %d messages, %v", n, err)
+			}
+
+			_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 10)
+			for i := range ms {
+				n, err := client.Read(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := string(buf[:n]); got != fmt.Sprintf("msg%d", i) || ms[i].N != 4 {
+					t.Errorf("unexpected message %q, written %d", got, ms[i].N)
+				}
+			}
+			if got := strings.Join(filter.sent, " "); got != "msg0 msg1 msg2" {
+				t.Errorf("unexpected outgoing packets %q", got)
+			}
+			if stats := vconn.Stats(); stats.PacketsWritten != 3 || stats.BytesWritten != 12 {
+				t.Errorf("unexpected stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestContextMethods(t *testing.T) {
+	server, client := newTestPair(t)
+
+	pf := NewPacketFilter(server)
+	defer pf.Close()
+	conn := pf.NewConn(1, nil).(Conn)
+	pf.Start()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadFromContext(ctx, make([]byte, 10))
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-readErr:
+		if err != context.Canceled {
+			t.Error("unexpected error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read did not unblock on cancellation")
+	}
+
+	expired, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	ms := []ipv4.Message{{Buffers: [][]byte{make([]byte, 10)}}}
+	if _, err := conn.ReadBatchContext(expired, ms, 0); err != context.DeadlineExceeded {
+		t.Error("unexpected batch error", err)
+	}
+	if _, err := conn.WriteToContext(ctx, []byte("x"), client.LocalAddr()); err != context.Canceled {
+		t.Error("unexpected write error", err)
+	}
+	if stats := conn.Stats(); stats.PacketsWritten != 0 {
+		t.Errorf("write with cancelled context went through %+v", stats)
+	}
+
+	// Live contexts behave like the plain methods.
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	live, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := conn.ReadBatchContext(live, ms, 0)
+	if err != nil || n != 1 || string(ms[0].Buffers[0][:ms[0].N]) != "hello" {
+		t.Errorf("unexpected batch read %d, %v", n, err)
+	}
+	if _, err := conn.WriteToContext(live, []byte("world"), client.LocalAddr()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server, _ := newTestPair(t)
+
+	var reasons []DropReason
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:       server,
+		BufferSize: 1500,
+		Backlog:    16,
+		RateLimit:  RateLimit{Rate: 1, Burst: 2, MaxSources: 2},
+		UnclaimedHandler: func(data, oob []byte, addr net.Addr, reason DropReason) {
+			reasons = append(reasons, reason)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	limited, err := pf.NewConnWithConfig(ConnConfig{
+		Priority:  1,
+		Filter:    prefixFilter("l"),
+		RateLimit: RateLimit{Rate: 1, Burst: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback := pf.NewConn(2, nil)
+
+	start := time.Now()
+	send := func(data string, host byte, at time.Duration) {
+		msg := testMessage(pf, data)
+		msg.Addr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, host), Port: 1234}
+		msg.ReceivedAt = start.Add(at)
+		pf.dispatch(msg)
+	}
+
+	// The global limit allows a burst of two per source.
+	send("a", 1, 0)
+	send("b", 1, 0)
+	send("c", 1, 0)
+	send("d", 2, 0)
+	// Refilled after a second.
+	send("e", 1, time.Second)
+	if got := readAll(fallback); got != "a b d e " {
+		t.Errorf("fallback got %q", got)
+	}
+
+	// The connection's own limit drops claimed packets, rather than passing
+	// them on.
+	send("l1", 3, 0)
+	send("l2", 3, 0)
+	if got := readAll(limited); got != "l1 " {
+		t.Errorf("limited conn got %q", got)
+	}
+	if got := readAll(fallback); got != "" {
+		t.Errorf("fallback got %q", got)
+	}
+
+	// Sources are evicted once there are too many, resetting their buckets.
+	send("f", 2, 2*time.Second)
+	send("g", 3, 2*time.Second)
+	send("h", 1, 2*time.Second)
+	send("i", 1, 2*time.Second)
+	send("j", 1, 2*time.Second)
+	if got := readAll(fallback); got != "f g h i " {
+		t.Errorf("fallback got %q", got)
+	}
+
+	if pf.RateLimited() != 3 || unwrapConn(limited).Stats().PacketsRateLimited != 1 {
+		t.Errorf("unexpected counters %d, %+v", pf.RateLimited(), unwrapConn(limited).Stats())
+	}
+	if len(reasons) != 3 || reasons[0] != DropRateLimited || reasons[2] != DropRateLimited {
+		t.Errorf("unexpected drop reasons %v", reasons)
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl, err := NewACL(true,
+		ACLRule{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Deny: true},
+		ACLRule{Prefix: netip.MustParsePrefix("10.1.0.0/16")},
+		ACLRule{Prefix: netip.MustParsePrefix("10.1.2.3/32"), Deny: true},
+		ACLRule{Prefix: netip.MustParsePrefix("::ffff:192.168.0.0/112"), Deny: true},
+		ACLRule{Prefix: netip.MustParsePrefix("fd00::/8"), Deny: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, allowed := range map[string]bool{
+		"10.0.0.1":           false,
+		"10.1.0.1":           true,
+		"10.1.2.3":           false,
+		"::ffff:10.1.0.1":    true,
+		"192.168.1.1":        false,
+		"172.16.0.1":         true,
+		"fd00::1":            false,
+		"2001:db8::1":        true,
+		"::ffff:192.168.0.1": false,
+	} {
+		if got := acl.Allowed(netip.MustParseAddr(addr)); got != allowed {
+			t.Errorf("%s: allowed %v, expected %v", addr, got, allowed)
+		}
+	}
+	if _, err := NewACL(true, ACLRule{}); err == nil {
+		t.Error("expected error for invalid prefix")
+	}
+
+	server, _ := newTestPair(t)
+	var reasons []DropReason
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:       server,
+		BufferSize: 1500,
+		Backlog:    16,
+		ACL:        acl,
+		UnclaimedHandler: func(data, oob []byte, addr net.Addr, reason DropReason) {
+			reasons = append(reasons, reason)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	private, err := NewACL(false, ACLRule{Prefix: netip.MustParsePrefix("172.16.0.0/12")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aclFilter := NewACLFilter(private, prefixFilter("a"))
+	admin := pf.NewConn(1, aclFilter)
+	fallback := pf.NewConn(2, nil)
+
+	send := func(data string, ip net.IP) {
+		msg := testMessage(pf, data)
+		msg.Addr = &net.UDPAddr{IP: ip, Port: 1234}
+		pf.dispatch(msg)
+	}
+
+	send("a1", net.IPv4(172, 16, 0, 1))
+	send("b1", net.IPv4(172, 16, 0, 1))
+	send("a2", net.IPv4(8, 8, 8, 8))
+	send("a3", net.IPv4(10, 0, 0, 1))
+	if got := readAll(admin); got != "a1 " {
+		t.Errorf("admin got %q", got)
+	}
+	if got := readAll(fallback); got != "b1 a2 " {
+		t.Errorf("fallback got %q", got)
+	}
+
+	// Both lists can be replaced at runtime.
+	aclFilter.SetACL(nil)
+	pf.SetACL(nil)
+	send("a4", net.IPv4(8, 8, 8, 8))
+	send("a5", net.IPv4(10, 0, 0, 1))
+	if got := readAll(admin); got != "a4 a5 " {
+		t.Errorf("admin got %q", got)
+	}
+
+	if pf.Denied() != 1 || pf.Stats().Denied != 1 {
+		t.Errorf("unexpected denied count %d", pf.Denied())
+	}
+	if len(reasons) != 1 || reasons[0] != DropDenied {
+		t.Errorf("unexpected drop reasons %v", reasons)
+	}
+}
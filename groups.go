@@ -0,0 +1,109 @@
+package pfilter
+
+import (
+	"errors"
+	"net"
+)
+
+// Balance decides how packets claimed by a group are distributed among the
+// connections in the group.
+type Balance int
+
+const (
+	// BalanceRoundRobin hands packets to group members in turn.
+	BalanceRoundRobin Balance = iota
+	// BalanceLeastQueued hands packets to the member with the fewest packets
+	// queued for reading.
+	BalanceLeastQueued
+	// BalanceSourceHash hands packets to a member chosen by the hash of the
+	// remote address, preserving per-peer ordering as long as the group's
+	// membership does not change.
+	BalanceSourceHash
+)
+
+// GroupConfig configures a group of connections created via NewGroup.
+type GroupConfig struct {
+	// Name of the group, used in ConnConfig.Group to join it.
+	Name string
+
+	// Priority and Filter of the group work the same way as for individual
+	// connections. A packet claimed by the filter is handed to one of the
+	// members of the group.
+	Priority int
+	Filter   Filter
+
+	// Balance decides which member receives each claimed packet.
+	Balance Balance
+}
+
+var (
+	errGroupExists    = errors.New("group already exists")
+	errNoSuchGroup    = errors.New("no such group")
+	errGroupMember    = errors.New("not supported for connections in a group")
+	errInvalidBalance = errors.New("invalid balance")
+)
+
+type connGroup struct {
+	name     string
+	priority int
+	seq      uint64
+	filter   Filter
+	balance  Balance
+
+	// Only accessed by the read loop.
+	next uint64
+}
+
+// NewGroup creates a group of connections sharing a single filter and
+// priority. Connections join the group via ConnConfig.Group, and claimed
+// packets are distributed among them according to the balance mode. A group
+// without members does not claim any packets.
+func (d *PacketFilter) NewGroup(config GroupConfig) error {
+	if config.Balance < BalanceRoundRobin || config.Balance > BalanceSourceHash {
+		return errInvalidBalance
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if _, ok := d.groups[config.Name]; ok {
+		return errGroupExists
+	}
+	if d.groups == nil {
+		d.groups = make(map[string]*connGroup)
+	}
+	d.nextSeq++
+	d.groups[config.Name] = &connGroup{
+		name:     config.Name,
+		priority: config.Priority,
+		seq:      d.nextSeq,
+		filter:   config.Filter,
+		balance:  config.Balance,
+	}
+
+	old := d.loadTable().conns
+	conns := make([]*filteredConn, len(old))
+	copy(conns, old)
+	d.storeTableLocked(conns)
+	return nil
+}
+
+// pick chooses the member that should receive a packet from the given address.
+func (g *connGroup) pick(members []*filteredConn, addr net.Addr) *filteredConn {
+	switch g.balance {
+	case BalanceLeastQueued:
+		best := members[0]
+		for _, member := range members[1:] {
+			if len(member.recvBuffer) < len(best.recvBuffer) {
+				best = member
+			}
+		}
+		return best
+	case BalanceSourceHash:
+		return members[addrHash(addr)%uint32(len(members))]
+	default:
+		member := members[g.next%uint64(len(members))]
+		g.next++
+		return member
+	}
+}
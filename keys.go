@@ -0,0 +1,38 @@
+package pfilter
+
+import (
+	"errors"
+	"net"
+)
+
+// KeyFunc extracts a key from an incoming packet, which is used to find the
+// connection that registered for it via ConnConfig.Keys or AddKey. Returning
+// false means the packet has no key, and is offered to connection filters
+// instead.
+type KeyFunc func(data []byte, addr net.Addr) (key string, ok bool)
+
+// RemoteAddrKey is a KeyFunc keying packets by the string form of their
+// remote address.
+func RemoteAddrKey(_ []byte, addr net.Addr) (string, bool) {
+	if addr == nil {
+		return "", false
+	}
+	return addr.String(), true
+}
+
+// ByteRangeKey returns a KeyFunc keying packets by the given range of their
+// payload, for example a session or connection ID at a fixed offset. Packets
+// that are too short have no key.
+func ByteRangeKey(offset, length int) KeyFunc {
+	return func(data []byte, _ net.Addr) (string, bool) {
+		if offset < 0 || length < 0 || len(data) < offset+length {
+			return "", false
+		}
+		return string(data[offset : offset+length]), true
+	}
+}
+
+var (
+	errNoKeyFunc = errors.New("packet filter has no key function configured")
+	errKeyInUse  = errors.New("key already registered by another connection")
+)
@@ -0,0 +1,183 @@
+// Package metrics exports the counters of a pfilter.PacketFilter as
+// Prometheus metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/AudriusButkevicius/pfilter"
+)
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// Collector implements prometheus.Collector over a packet filter. Per
+// connection metrics are labelled with the connection name given via
+// pfilter.ConnConfig, connections sharing the same name are summed up.
+type Collector struct {
+	filter *pfilter.PacketFilter
+
+	dropped   *prometheus.Desc
+	overflow  *prometheus.Desc
+	claimed   *prometheus.Desc
+	copied    *prometheus.Desc
+	rejected  *prometheus.Desc
+	truncated *prometheus.Desc
+	limited   *prometheus.Desc
+	denied    *prometheus.Desc
+	conns     *prometheus.Desc
+
+	connClaimedPackets    *prometheus.Desc
+	connClaimedBytes      *prometheus.Desc
+	connCopiedPackets     *prometheus.Desc
+	connRejectedPackets   *prometheus.Desc
+	connLimitedPackets    *prometheus.Desc
+	connDeliveredPackets  *prometheus.Desc
+	connDeliveredBytes    *prometheus.Desc
+	connOverflowedPackets *prometheus.Desc
+	connOverflowedBytes   *prometheus.Desc
+	connByteLimited       *prometheus.Desc
+	connMemoryLimited     *prometheus.Desc
+	connEvictedPackets    *prometheus.Desc
+	connTimedOutPackets   *prometheus.Desc
+	connWrittenPackets    *prometheus.Desc
+	connWrittenBytes      *prometheus.Desc
+	connQueueLength       *prometheus.Desc
+	connQueueBytes        *prometheus.Desc
+}
+
+// NewCollector returns a collector for the given packet filter. All metric
+// names are prefixed with the given namespace (which may be empty) and the
+// pfilter subsystem. Constant labels are attached to every metric, which allows
+// registering collectors for multiple packet filters with the same registry.
+func NewCollector(filter *pfilter.PacketFilter, namespace string, constLabels prometheus.Labels) *Collector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "pfilter", name), help, labels, constLabels)
+	}
+	return &Collector{
+		filter: filter,
+
+		dropped:   desc("dropped_packets_total", "Packets dropped due to nobody claiming them."),
+		overflow:  desc("overflow_packets_total", "Packets dropped due to receive buffers being full."),
+		claimed:   desc("claimed_packets_total", "Packets claimed by connections."),
+		copied:    desc("copied_packets_total", "Packet copies delivered due to copy verdicts."),
+		rejected:  desc("rejected_packets_total", "Packets dropped due to drop verdicts."),
+		truncated: desc("truncated_packets_total", "Packets larger than the read buffer size."),
+		limited:   desc("rate_limited_packets_total", "Packets dropped due to rate limits."),
+		denied:    desc("denied_packets_total", "Packets dropped due to the packet filter's ACL."),
+		conns:     desc("conns", "Number of active virtual connections."),
+
+		connClaimedPackets:    desc("conn_claimed_packets_total", "Packets claimed by the connection.", "conn"),
+		connClaimedBytes:      desc("conn_claimed_bytes_total", "Payload bytes claimed by the connection.", "conn"),
+		connCopiedPackets:     desc("conn_copied_packets_total", "Packet copies delivered to the connection.", "conn"),
+		connRejectedPackets:   desc("conn_rejected_packets_total", "Packets dropped due to the connection's filter returning a drop verdict.", "conn"),
+		connLimitedPackets:    desc("conn_rate_limited_packets_total", "Packets dropped due to the connection's rate limit.", "conn"),
+		connDeliveredPackets:  desc("conn_delivered_packets_total", "Packets read from the connection.", "conn"),
+		connDeliveredBytes:    desc("conn_delivered_bytes_total", "Payload bytes read from the connection.", "conn"),
+		connOverflowedPackets: desc("conn_overflowed_packets_total", "Claimed packets dropped due to the receive buffer being full.", "conn"),
+		connOverflowedBytes:   desc("conn_overflowed_bytes_total", "Claimed payload bytes dropped due to the receive buffer being full.", "conn"),
+		connByteLimited:       desc("conn_byte_limited_packets_total", "Claimed packets dropped due to the connection's byte limit.", "conn"),
+		connMemoryLimited:     desc("conn_memory_limited_packets_total", "Claimed packets dropped due to the packet filter's byte limit.", "conn"),
+		connEvictedPackets:    desc("conn_evicted_packets_total", "Queued packets evicted to make room for newer ones.", "conn"),
+		connTimedOutPackets:   desc("conn_timed_out_packets_total", "Claimed packets dropped after waiting for room in the receive buffer.", "conn"),
+		connWrittenPackets:    desc("conn_written_packets_total", "Packets written via the connection.", "conn"),
+		connWrittenBytes:      desc("conn_written_bytes_total", "Payload bytes written via the connection.", "conn"),
+		connQueueLength:       desc("conn_queue_length", "Packets currently queued for reading.", "conn"),
+		connQueueBytes:        desc("conn_queue_bytes", "Memory held by the packets currently queued for reading.", "conn"),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.dropped
+	ch <- c.overflow
+	ch <- c.claimed
+	ch <- c.copied
+	ch <- c.rejected
+	ch <- c.truncated
+	ch <- c.limited
+	ch <- c.denied
+	ch <- c.conns
+	ch <- c.connClaimedPackets
+	ch <- c.connClaimedBytes
+	ch <- c.connCopiedPackets
+	ch <- c.connRejectedPackets
+	ch <- c.connLimitedPackets
+	ch <- c.connDeliveredPackets
+	ch <- c.connDeliveredBytes
+	ch <- c.connOverflowedPackets
+	ch <- c.connOverflowedBytes
+	ch <- c.connByteLimited
+	ch <- c.connMemoryLimited
+	ch <- c.connEvictedPackets
+	ch <- c.connTimedOutPackets
+	ch <- c.connWrittenPackets
+	ch <- c.connWrittenBytes
+	ch <- c.connQueueLength
+	ch <- c.connQueueBytes
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.filter.Stats()
+
+	// Sum up connections sharing a name, as a label set may only be reported
+	// once. Closed connections are included, so that counters never decrease.
+	var names []string
+	byName := make(map[string]*pfilter.ConnStats)
+	for _, conn := range append(stats.Conns, stats.Closed...) {
+		sum, ok := byName[conn.Name]
+		if !ok {
+			sum = &pfilter.ConnStats{Name: conn.Name}
+			byName[conn.Name] = sum
+			names = append(names, conn.Name)
+		}
+		sum.PacketsClaimed += conn.PacketsClaimed
+		sum.BytesClaimed += conn.BytesClaimed
+		sum.PacketsCopied += conn.PacketsCopied
+		sum.PacketsRejected += conn.PacketsRejected
+		sum.PacketsRateLimited += conn.PacketsRateLimited
+		sum.PacketsDelivered += conn.PacketsDelivered
+		sum.BytesDelivered += conn.BytesDelivered
+		sum.PacketsOverflowed += conn.PacketsOverflowed
+		sum.BytesOverflowed += conn.BytesOverflowed
+		sum.PacketsByteLimited += conn.PacketsByteLimited
+		sum.PacketsMemoryLimited += conn.PacketsMemoryLimited
+		sum.PacketsEvicted += conn.PacketsEvicted
+		sum.PacketsTimedOut += conn.PacketsTimedOut
+		sum.PacketsWritten += conn.PacketsWritten
+		sum.BytesWritten += conn.BytesWritten
+		sum.QueueLength += conn.QueueLength
+		sum.QueueBytes += conn.QueueBytes
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(stats.Dropped))
+	ch <- prometheus.MustNewConstMetric(c.overflow, prometheus.CounterValue, float64(stats.Overflow))
+	ch <- prometheus.MustNewConstMetric(c.claimed, prometheus.CounterValue, float64(stats.Claimed))
+	ch <- prometheus.MustNewConstMetric(c.copied, prometheus.CounterValue, float64(stats.Copied))
+	ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(stats.Rejected))
+	ch <- prometheus.MustNewConstMetric(c.truncated, prometheus.CounterValue, float64(stats.Truncated))
+	ch <- prometheus.MustNewConstMetric(c.limited, prometheus.CounterValue, float64(stats.RateLimited))
+	ch <- prometheus.MustNewConstMetric(c.denied, prometheus.CounterValue, float64(stats.Denied))
+	ch <- prometheus.MustNewConstMetric(c.conns, prometheus.GaugeValue, float64(len(stats.Conns)))
+
+	for _, name := range names {
+		conn := byName[name]
+		ch <- prometheus.MustNewConstMetric(c.connClaimedPackets, prometheus.CounterValue, float64(conn.PacketsClaimed), name)
+		ch <- prometheus.MustNewConstMetric(c.connClaimedBytes, prometheus.CounterValue, float64(conn.BytesClaimed), name)
+		ch <- prometheus.MustNewConstMetric(c.connCopiedPackets, prometheus.CounterValue, float64(conn.PacketsCopied), name)
+		ch <- prometheus.MustNewConstMetric(c.connRejectedPackets, prometheus.CounterValue, float64(conn.PacketsRejected), name)
+		ch <- prometheus.MustNewConstMetric(c.connLimitedPackets, prometheus.CounterValue, float64(conn.PacketsRateLimited), name)
+		ch <- prometheus.MustNewConstMetric(c.connDeliveredPackets, prometheus.CounterValue, float64(conn.PacketsDelivered), name)
+		ch <- prometheus.MustNewConstMetric(c.connDeliveredBytes, prometheus.CounterValue, float64(conn.BytesDelivered), name)
+		ch <- prometheus.MustNewConstMetric(c.connOverflowedPackets, prometheus.CounterValue, float64(conn.PacketsOverflowed), name)
+		ch <- prometheus.MustNewConstMetric(c.connOverflowedBytes, prometheus.CounterValue, float64(conn.BytesOverflowed), name)
+		ch <- prometheus.MustNewConstMetric(c.connByteLimited, prometheus.CounterValue, float64(conn.PacketsByteLimited), name)
+		ch <- prometheus.MustNewConstMetric(c.connMemoryLimited, prometheus.CounterValue, float64(conn.PacketsMemoryLimited), name)
+		ch <- prometheus.MustNewConstMetric(c.connEvictedPackets, prometheus.CounterValue, float64(conn.PacketsEvicted), name)
+		ch <- prometheus.MustNewConstMetric(c.connTimedOutPackets, prometheus.CounterValue, float64(conn.PacketsTimedOut), name)
+		ch <- prometheus.MustNewConstMetric(c.connWrittenPackets, prometheus.CounterValue, float64(conn.PacketsWritten), name)
+		ch <- prometheus.MustNewConstMetric(c.connWrittenBytes, prometheus.CounterValue, float64(conn.BytesWritten), name)
+		ch <- prometheus.MustNewConstMetric(c.connQueueLength, prometheus.GaugeValue, float64(conn.QueueLength), name)
+		ch <- prometheus.MustNewConstMetric(c.connQueueBytes, prometheus.GaugeValue, float64(conn.QueueBytes), name)
+	}
+}
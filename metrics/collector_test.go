@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/AudriusButkevicius/pfilter"
+)
+
+func TestCollector(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	pf := pfilter.NewPacketFilter(server)
+	var conns []net.PacketConn
+	for i := 0; i < 2; i++ {
+		conn, err := pf.NewConnWithConfig(pfilter.ConnConfig{Priority: 10, Name: "worker"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	pf.Start()
+	defer pf.Close()
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pf.Stats().Conns[0].QueueLength == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("packet not received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(NewCollector(pf, "test", prometheus.Labels{"filter": "main"}))
+
+	expected := `
+# HELP test_pfilter_conn_claimed_bytes_total Payload bytes claimed by the connection.
+# TYPE test_pfilter_conn_claimed_bytes_total counter
+test_pfilter_conn_claimed_bytes_total{conn="worker",filter="main"} 5
+# HELP test_pfilter_conn_queue_length Packets currently queued for reading.
+# TYPE test_pfilter_conn_queue_length gauge
+test_pfilter_conn_queue_length{conn="worker",filter="main"} 1
+# HELP test_pfilter_conns Number of active virtual connections.
+# TYPE test_pfilter_conns gauge
+test_pfilter_conns{filter="main"} 2
+`
+	err = testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"test_pfilter_conn_claimed_bytes_total", "test_pfilter_conn_queue_length", "test_pfilter_conns")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Counters of closed connections are kept.
+	if err := conns[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected = `
+# HELP test_pfilter_claimed_packets_total Packets claimed by connections.
+# TYPE test_pfilter_claimed_packets_total counter
+test_pfilter_claimed_packets_total{filter="main"} 1
+# HELP test_pfilter_conn_claimed_bytes_total Payload bytes claimed by the connection.
+# TYPE test_pfilter_conn_claimed_bytes_total counter
+test_pfilter_conn_claimed_bytes_total{conn="worker",filter="main"} 5
+# HELP test_pfilter_conns Number of active virtual connections.
+# TYPE test_pfilter_conns gauge
+test_pfilter_conns{filter="main"} 1
+`
+	err = testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"test_pfilter_claimed_packets_total", "test_pfilter_conn_claimed_bytes_total", "test_pfilter_conns")
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -2,9 +2,8 @@ package pfilter
 
 import (
 	"net"
-	"sync"
-
-	"golang.org/x/net/ipv4"
+	"os"
+	"time"
 )
 
 var (
@@ -18,6 +17,11 @@ var (
 		timeout:   false,
 		temporary: false,
 	}
+	errTruncated = &netError{
+		msg:       "message truncated",
+		timeout:   false,
+		temporary: true,
+	}
 	errNotSupported = &netError{
 		msg:       "not supported",
 		timeout:   false,
@@ -38,35 +42,132 @@ func (e *netError) Error() string   { return e.msg }
 func (e *netError) Timeout() bool   { return e.timeout }
 func (e *netError) Temporary() bool { return e.temporary }
 
+// Is makes timeouts match os.ErrDeadlineExceeded, like those of the net package.
+func (e *netError) Is(target error) bool {
+	return e.timeout && target == os.ErrDeadlineExceeded
+}
+
+// OverflowPolicy decides what happens to a packet claimed by a connection whose
+// receive buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDefault uses the policy set in Config, or OverflowDropNewest if
+	// used in Config itself.
+	OverflowDefault OverflowPolicy = iota
+	// OverflowDropNewest drops the packet that was just claimed.
+	OverflowDropNewest
+	// OverflowDropOldest evicts the oldest queued packets to make room for
+	// the one that was just claimed.
+	OverflowDropOldest
+	// OverflowBlock blocks the read loop until there is room in the receive
+	// buffer, or until the block timeout expires, in which case the claimed
+	// packet is dropped. This stalls delivery to all other connections too.
+	OverflowBlock
+)
+
+func (p OverflowPolicy) valid() bool {
+	return p >= OverflowDefault && p <= OverflowBlock
+}
+
+// overflowReason tells which limit prevented a message from being queued.
+type overflowReason int
+
+const (
+	overflowNone overflowReason = iota
+	// The receive buffer is full, as limited by Config.Backlog.
+	overflowBacklog
+	// The connection's byte limit, ConnConfig.BacklogBytes, would be exceeded.
+	overflowConnBytes
+	// The global byte limit, Config.MaxBufferedBytes, would be exceeded.
+	overflowMemory
+)
+
 type filteredConnList []*filteredConn
 
-func (r filteredConnList) Len() int           { return len(r) }
-func (r filteredConnList) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
-func (r filteredConnList) Less(i, j int) bool { return r[i].priority < r[j].priority }
+func (r filteredConnList) Len() int      { return len(r) }
+func (r filteredConnList) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r filteredConnList) Less(i, j int) bool {
+	if r[i].priority != r[j].priority {
+		return r[i].priority < r[j].priority
+	}
+	return r[i].seq < r[j].seq
+}
+
+// filterBox allows storing filters of different types in an atomic.Value.
+type filterBox struct {
+	Filter
+}
+
+// maxDatagramSize is the maximum length of a UDP datagram, which also bounds
+// datagrams coalesced by receive offload.
+const maxDatagramSize = 65535
 
+// messageWithError is a received packet. Buf and OOB are buffers obtained from
+// the allocator, of which the first N and NN bytes are used.
 type messageWithError struct {
-	ipv4.Message
-	Err error
+	Buf   []byte
+	OOB   []byte
+	Addr  net.Addr
+	N     int
+	NN    int
+	Flags int
+	Err   error
+
+	ReceivedAt time.Time
+
+	// Built on first use by packet.
+	pkt *Packet
+}
+
+// Data returns the payload of the message.
+func (m *messageWithError) Data() []byte {
+	return m.Buf[:m.N]
 }
 
-func (m *messageWithError) Copy(pool *sync.Pool) messageWithError {
-	buf := pool.Get().([]byte)
-	oobBuf := pool.Get().([]byte)
+// packet returns the context of the message passed to ContextFilters. It is
+// built lazily, as parsing control messages is not free.
+func (m *messageWithError) packet() *Packet {
+	if m.pkt == nil {
+		m.pkt = &Packet{
+			Data:       m.Data(),
+			Addr:       m.Addr,
+			ReceivedAt: m.ReceivedAt,
+		}
+		if m.NN > 0 {
+			m.pkt.Control = parseControlMessage(m.OOB[:m.NN])
+		}
+	}
+	return m.pkt
+}
 
-	copy(buf, m.Buffers[0][:m.N])
+// size returns the number of bytes the message accounts for in byte limits,
+// which is the memory held by its buffers rather than the length of its
+// contents.
+func (m *messageWithError) size() int {
+	return cap(m.Buf) + cap(m.OOB)
+}
+
+// Copy returns a copy of the message in buffers sized to fit its contents.
+func (m *messageWithError) Copy(alloc Allocator) messageWithError {
+	buf := alloc.Get(m.N)
+	copy(buf, m.Buf[:m.N])
+
+	var oobBuf []byte
 	if m.NN > 0 {
+		oobBuf = alloc.Get(m.NN)
 		copy(oobBuf, m.OOB[:m.NN])
 	}
 
 	return messageWithError{
-		Message: ipv4.Message{
-			Buffers: [][]byte{buf[:m.N]},
-			OOB:     oobBuf[:m.NN],
-			Addr:    m.Addr,
-			N:       m.N,
-			NN:      m.NN,
-			Flags:   m.Flags,
-		},
-		Err: m.Err,
+		Buf:   buf,
+		OOB:   oobBuf,
+		Addr:  m.Addr,
+		N:     m.N,
+		NN:    m.NN,
+		Flags: m.Flags,
+		Err:   m.Err,
+
+		ReceivedAt: m.ReceivedAt,
 	}
 }
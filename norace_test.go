@@ -0,0 +1,5 @@
+//go:build !race
+
+package pfilter
+
+const raceEnabled = false
@@ -0,0 +1,87 @@
+package pfilter
+
+import (
+	"errors"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Not defined by x/sys/unix at the version in use, see linux/udp.h.
+const (
+	udpSegment = 103
+	udpGRO     = 104
+)
+
+// enableGRO asks the kernel to coalesce received datagrams of the same flow.
+func enableGRO(conn *net.UDPConn) error {
+	return setsockoptInt(conn, unix.IPPROTO_UDP, udpGRO, 1)
+}
+
+// checkGSO returns an error if the kernel does not support UDP segmentation
+// offload.
+func checkGSO(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		_, serr = unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, udpSegment)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func setsockoptInt(conn *net.UDPConn, level, opt, value int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), level, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// isGSOError returns true if a segmented send failed because the device does
+// not support segmentation offload.
+func isGSOError(err error) bool {
+	return errors.Is(err, unix.EIO)
+}
+
+// groSegmentSize returns the size of the segments a coalesced datagram
+// consists of, or zero if the datagram was not coalesced.
+func groSegmentSize(oob []byte) int {
+	for len(oob) > 0 {
+		hdr, data, rest, err := unix.ParseOneSocketControlMessage(oob)
+		if err != nil {
+			return 0
+		}
+		if hdr.Level == unix.IPPROTO_UDP && hdr.Type == udpGRO && len(data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&data[0])))
+		}
+		oob = rest
+	}
+	return 0
+}
+
+// appendGSO appends the control message segmenting a datagram into segments of
+// the given size.
+func appendGSO(oob []byte, segmentSize int) []byte {
+	start := len(oob)
+	oob = append(oob, make([]byte, unix.CmsgSpace(2))...)
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&oob[start]))
+	hdr.Level = unix.IPPROTO_UDP
+	hdr.Type = udpSegment
+	hdr.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[start+unix.CmsgLen(0)])) = uint16(segmentSize)
+	return oob
+}
@@ -0,0 +1,137 @@
+package pfilter
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOffload(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	receiver, err := NewPacketFilterWithConfig(Config{
+		Conn:       server,
+		BufferSize: maxDatagramSize,
+		Backlog:    64,
+		GRO:        true,
+	})
+	if err != nil {
+		t.Skip("receive offload not supported:", err)
+	}
+	defer receiver.Close()
+	sender, err := NewPacketFilterWithConfig(Config{
+		Conn:       client,
+		BufferSize: 1500,
+		Backlog:    64,
+		GSO:        true,
+	})
+	if err != nil {
+		t.Skip("segmentation offload not supported:", err)
+	}
+	defer sender.Close()
+
+	filter := &outgoingFilter{}
+	out := sender.NewConn(1, filter).(Conn)
+	in := receiver.NewConn(1, nil)
+	receiver.Start()
+
+	const segmentSize = 100
+	data := make([]byte, 10*segmentSize+50)
+	for i := range data {
+		data[i] = byte(i / segmentSize)
+	}
+	n, err := out.WriteSegments(data, segmentSize, server.LocalAddr())
+	if err != nil || n != len(data) {
+		t.Fatalf("wrote %d bytes, %v", n, err)
+	}
+	if len(filter.sent) != 11 {
+		t.Errorf("unexpected number of outgoing packets %d", len(filter.sent))
+	}
+	if stats := out.Stats(); stats.PacketsWritten != 11 || stats.BytesWritten != uint64(len(data)) {
+		t.Errorf("unexpected sender stats %+v", stats)
+	}
+
+	_ = in.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxDatagramSize)
+	for offset := 0; offset < len(data); offset += segmentSize {
+		n, _, err := in.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := data[offset:segmentEnd(data, offset, segmentSize)]; !bytes.Equal(buf[:n], expected) {
+			t.Fatalf("unexpected segment at %d, got %d bytes", offset, n)
+		}
+	}
+}
+
+// eioConn fails segmented sends like a device without checksum offload.
+type eioConn struct {
+	*net.UDPConn
+	segmented int
+}
+
+func (c *eioConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	if len(oob) > 0 {
+		c.segmented++
+		return 0, 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: os.NewSyscallError("sendmsg", unix.EIO)}
+	}
+	return c.UDPConn.WriteMsgUDP(b, oob, addr)
+}
+
+func TestGSOFallback(t *testing.T) {
+	server, _ := newTestPair(t)
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	pf := NewPacketFilter(client)
+	defer pf.Close()
+	stub := &eioConn{UDPConn: client}
+	pf.oobConn = stub
+	pf.gso = 1
+	conn := pf.NewConn(1, nil).(Conn)
+
+	const segmentSize = 10
+	data := make([]byte, 3*segmentSize+5)
+	for i := range data {
+		data[i] = byte(i / segmentSize)
+	}
+	for i := 0; i < 2; i++ {
+		n, err := conn.WriteSegments(data, segmentSize, server.LocalAddr())
+		if err != nil || n != len(data) {
+			t.Fatalf("wrote %d bytes, %v", n, err)
+		}
+	}
+	if stub.segmented != 1 {
+		t.Errorf("segmented sends attempted %d times, expected once", stub.segmented)
+	}
+
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	for i := 0; i < 2; i++ {
+		for offset := 0; offset < len(data); offset += segmentSize {
+			n, _, err := server.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := data[offset:segmentEnd(data, offset, segmentSize)]; !bytes.Equal(buf[:n], expected) {
+				t.Fatalf("unexpected segment at %d, got %d bytes", offset, n)
+			}
+		}
+	}
+}
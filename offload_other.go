@@ -0,0 +1,27 @@
+//go:build !linux
+
+package pfilter
+
+import (
+	"net"
+)
+
+func enableGRO(*net.UDPConn) error {
+	return errNotSupported
+}
+
+func checkGSO(*net.UDPConn) error {
+	return errNotSupported
+}
+
+func isGSOError(error) bool {
+	return false
+}
+
+func groSegmentSize([]byte) int {
+	return 0
+}
+
+func appendGSO(oob []byte, _ int) []byte {
+	return oob
+}
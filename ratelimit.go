@@ -0,0 +1,122 @@
+package pfilter
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// defaultMaxSources is the default number of sources a rate limiter tracks.
+const defaultMaxSources = 4096
+
+var errInvalidRateLimit = errors.New("invalid rate limit")
+
+// RateLimit configures a token bucket per remote IP address. The zero value
+// disables rate limiting.
+type RateLimit struct {
+	// Packets per second allowed from each remote address.
+	Rate float64
+	// Number of packets a remote address may send in a burst. Defaults to
+	// Rate, but at least one.
+	Burst int
+	// Number of remote addresses tracked, evicting the least recently seen
+	// one once exceeded. Defaults to 4096.
+	MaxSources int
+}
+
+func (l RateLimit) valid() bool {
+	return l.Rate >= 0 && l.Burst >= 0 && l.MaxSources >= 0
+}
+
+// rateLimiter keeps a token bucket per remote address, bounded in size by
+// evicting the least recently seen address. Only used from the read loop, so
+// it needs no locking.
+type rateLimiter struct {
+	rate       float64
+	burst      float64
+	maxSources int
+
+	sources map[netip.Addr]*list.Element
+	lru     list.List // Of *bucket, most recently seen first.
+}
+
+type bucket struct {
+	addr   netip.Addr
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rate limiter for the given configuration, or nil if
+// rate limiting is disabled.
+func newRateLimiter(config RateLimit) *rateLimiter {
+	if config.Rate == 0 {
+		return nil
+	}
+	if config.Burst == 0 {
+		config.Burst = int(config.Rate)
+		if config.Burst < 1 {
+			config.Burst = 1
+		}
+	}
+	if config.MaxSources == 0 {
+		config.MaxSources = defaultMaxSources
+	}
+	return &rateLimiter{
+		rate:       config.Rate,
+		burst:      float64(config.Burst),
+		maxSources: config.MaxSources,
+		sources:    make(map[netip.Addr]*list.Element),
+	}
+}
+
+// allow takes a token from the bucket of the given address, returning false if
+// there are none left. Packets from addresses without an IP are always allowed.
+func (l *rateLimiter) allow(addr net.Addr, now time.Time) bool {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return true
+	}
+
+	var b *bucket
+	if elem, ok := l.sources[ip]; ok {
+		l.lru.MoveToFront(elem)
+		b = elem.Value.(*bucket)
+		if elapsed := now.Sub(b.last); elapsed > 0 {
+			b.tokens += elapsed.Seconds() * l.rate
+			if b.tokens > l.burst {
+				b.tokens = l.burst
+			}
+		}
+		b.last = now
+	} else {
+		if l.lru.Len() >= l.maxSources {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.sources, oldest.Value.(*bucket).addr)
+		}
+		b = &bucket{addr: ip, tokens: l.burst, last: now}
+		l.sources[ip] = l.lru.PushFront(b)
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+	default:
+		return netip.Addr{}, false
+	}
+	parsed, ok := netip.AddrFromSlice(ip)
+	return parsed.Unmap(), ok
+}
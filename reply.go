@@ -0,0 +1,85 @@
+package pfilter
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// maxReplySources bounds the number of peers a connection remembers the local
+// address for.
+const maxReplySources = 4096
+
+var errNoDstControl = errors.New("replying from the destination address requires Config.Control to include ControlDst")
+
+type replySource struct {
+	src     net.IP
+	ifIndex int
+}
+
+// replySources remembers the local address packets from each peer were sent
+// to, so that replies can be sent from the same address.
+type replySources struct {
+	mut   sync.Mutex
+	peers map[netip.AddrPort]replySource
+}
+
+func newReplySources() *replySources {
+	return &replySources{
+		peers: make(map[netip.AddrPort]replySource),
+	}
+}
+
+// learn records the destination address of the message for its sender.
+func (s *replySources) learn(msg *messageWithError) {
+	addr, ok := msg.Addr.(*net.UDPAddr)
+	if !ok || msg.NN == 0 {
+		return
+	}
+	cm := msg.packet().Control
+	// Multicast and broadcast addresses are no valid source addresses.
+	if cm == nil || !(cm.Dst.IsGlobalUnicast() || cm.Dst.IsLoopback() || cm.Dst.IsLinkLocalUnicast()) {
+		return
+	}
+	peer := udpAddrPort(addr)
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.peers[peer]; !ok && len(s.peers) >= maxReplySources {
+		for evict := range s.peers {
+			delete(s.peers, evict)
+			break
+		}
+	}
+	s.peers[peer] = replySource{
+		src:     cm.Dst,
+		ifIndex: cm.IfIndex,
+	}
+}
+
+// controlMessage returns the control message setting the source address for
+// packets to the given peer, or nil if no packets were received from it.
+func (s *replySources) controlMessage(addr *net.UDPAddr) []byte {
+	s.mut.Lock()
+	source, ok := s.peers[udpAddrPort(addr)]
+	s.mut.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if src := source.src.To4(); src != nil {
+		// The interface is left for routing to decide, only the source
+		// address is pinned.
+		return (&ipv4.ControlMessage{Src: src}).Marshal()
+	}
+	return (&ipv6.ControlMessage{Src: source.src, IfIndex: source.ifIndex}).Marshal()
+}
+
+func udpAddrPort(addr *net.UDPAddr) netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	return netip.AddrPortFrom(ip.Unmap(), uint16(addr.Port))
+}
@@ -0,0 +1,267 @@
+package pfilter
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats contains the counters of a single virtual connection.
+type ConnStats struct {
+	// Name of the connection, as given to NewConnWithConfig.
+	Name string
+	// Name of the group the connection is a member of, if any.
+	Group string
+	// Priority of the connection, as given to NewConn.
+	Priority int
+	// Number of packets currently queued for reading.
+	QueueLength int
+	// Memory held by the packets currently queued for reading, as accounted for
+	// in ConnConfig.BacklogBytes.
+	QueueBytes int
+
+	// Packets (and their payload bytes) that were claimed by the connection's filter.
+	PacketsClaimed uint64
+	BytesClaimed   uint64
+
+	// Copies of packets (and their payload bytes) that were delivered due to the
+	// connection's filter returning VerdictCopy. Not included in claimed.
+	PacketsCopied uint64
+	BytesCopied   uint64
+
+	// Packets (and their payload bytes) that were dropped due to the
+	// connection's filter returning VerdictDrop.
+	PacketsRejected uint64
+	BytesRejected   uint64
+
+	// Packets (and their payload bytes) that were claimed or copied, but
+	// dropped due to the connection's rate limit, ConnConfig.RateLimit.
+	PacketsRateLimited uint64
+	BytesRateLimited   uint64
+
+	// Packets (and their payload bytes) that were read from the connection.
+	PacketsDelivered uint64
+	BytesDelivered   uint64
+
+	// Packets (and their payload bytes) that were claimed, but dropped due to the
+	// receive buffer being full.
+	PacketsOverflowed uint64
+	BytesOverflowed   uint64
+
+	// Packets (and their payload bytes) that were claimed, but dropped due to
+	// the connection's byte limit, ConnConfig.BacklogBytes.
+	PacketsByteLimited uint64
+	BytesByteLimited   uint64
+
+	// Packets (and their payload bytes) that were claimed, but dropped due to
+	// the packet filter's byte limit, Config.MaxBufferedBytes.
+	PacketsMemoryLimited uint64
+	BytesMemoryLimited   uint64
+
+	// Queued packets (and their payload bytes) that were evicted to make room
+	// for newer ones, when using OverflowDropOldest.
+	PacketsEvicted uint64
+	BytesEvicted   uint64
+
+	// Number of times the read loop had to wait for room in the receive buffer,
+	// when using OverflowBlock.
+	Blocked uint64
+
+	// Packets (and their payload bytes) that were dropped after waiting for
+	// room in the receive buffer for longer than the block timeout.
+	PacketsTimedOut uint64
+	BytesTimedOut   uint64
+
+	// Packets (and their payload bytes) written via the connection.
+	PacketsWritten uint64
+	BytesWritten   uint64
+
+	// Time a packet was last claimed, read or written. Zero if there was no activity yet.
+	LastActivity time.Time
+}
+
+// Stats contains the counters of a packet filter and all of its connections.
+type Stats struct {
+	// Same as PacketFilter.Dropped
+	Dropped uint64
+	// Same as PacketFilter.Overflow
+	Overflow uint64
+	// Same as PacketFilter.Claimed
+	Claimed uint64
+	// Same as PacketFilter.Copied
+	Copied uint64
+	// Same as PacketFilter.Rejected
+	Rejected uint64
+	// Same as PacketFilter.Truncated
+	Truncated uint64
+	// Same as PacketFilter.RateLimited
+	RateLimited uint64
+	// Same as PacketFilter.Denied
+	Denied uint64
+	// Memory held by the packets queued across all connections, as accounted
+	// for in Config.MaxBufferedBytes.
+	QueuedBytes int
+
+	// Stats for each of the currently active connections, in the order in which
+	// they get to claim packets.
+	Conns []ConnStats
+	// Counters of the connections closed so far, summed up by name and sorted
+	// by it. Adding these to Conns gives totals which never decrease. Only the
+	// name and the counters are set.
+	Closed []ConnStats
+}
+
+type connCounters struct {
+	packetsClaimed       uint64
+	bytesClaimed         uint64
+	packetsCopied        uint64
+	bytesCopied          uint64
+	packetsRejected      uint64
+	bytesRejected        uint64
+	packetsRateLimited   uint64
+	bytesRateLimited     uint64
+	packetsDelivered     uint64
+	bytesDelivered       uint64
+	packetsOverflowed    uint64
+	bytesOverflowed      uint64
+	packetsByteLimited   uint64
+	bytesByteLimited     uint64
+	packetsMemoryLimited uint64
+	bytesMemoryLimited   uint64
+	packetsEvicted       uint64
+	bytesEvicted         uint64
+	blockedCount         uint64
+	packetsTimedOut      uint64
+	bytesTimedOut        uint64
+	packetsWritten       uint64
+	bytesWritten         uint64
+	lastActivity         int64
+}
+
+func (c *connCounters) claimed(n int) {
+	atomic.AddUint64(&c.packetsClaimed, 1)
+	atomic.AddUint64(&c.bytesClaimed, uint64(n))
+	c.touch()
+}
+
+func (c *connCounters) copied(n int) {
+	atomic.AddUint64(&c.packetsCopied, 1)
+	atomic.AddUint64(&c.bytesCopied, uint64(n))
+	c.touch()
+}
+
+func (c *connCounters) rejected(n int) {
+	atomic.AddUint64(&c.packetsRejected, 1)
+	atomic.AddUint64(&c.bytesRejected, uint64(n))
+}
+
+func (c *connCounters) rateLimited(n int) {
+	atomic.AddUint64(&c.packetsRateLimited, 1)
+	atomic.AddUint64(&c.bytesRateLimited, uint64(n))
+}
+
+func (c *connCounters) delivered(n int) {
+	atomic.AddUint64(&c.packetsDelivered, 1)
+	atomic.AddUint64(&c.bytesDelivered, uint64(n))
+	c.touch()
+}
+
+func (c *connCounters) overflowed(n int) {
+	atomic.AddUint64(&c.packetsOverflowed, 1)
+	atomic.AddUint64(&c.bytesOverflowed, uint64(n))
+}
+
+func (c *connCounters) byteLimited(n int) {
+	atomic.AddUint64(&c.packetsByteLimited, 1)
+	atomic.AddUint64(&c.bytesByteLimited, uint64(n))
+}
+
+func (c *connCounters) memoryLimited(n int) {
+	atomic.AddUint64(&c.packetsMemoryLimited, 1)
+	atomic.AddUint64(&c.bytesMemoryLimited, uint64(n))
+}
+
+func (c *connCounters) evicted(n int) {
+	atomic.AddUint64(&c.packetsEvicted, 1)
+	atomic.AddUint64(&c.bytesEvicted, uint64(n))
+}
+
+func (c *connCounters) blocked() {
+	atomic.AddUint64(&c.blockedCount, 1)
+}
+
+func (c *connCounters) timedOut(n int) {
+	atomic.AddUint64(&c.packetsTimedOut, 1)
+	atomic.AddUint64(&c.bytesTimedOut, uint64(n))
+}
+
+func (c *connCounters) written(n int) {
+	atomic.AddUint64(&c.packetsWritten, 1)
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+	c.touch()
+}
+
+func (c *connCounters) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+func (c *connCounters) snapshot() ConnStats {
+	stats := ConnStats{
+		PacketsClaimed:       atomic.LoadUint64(&c.packetsClaimed),
+		BytesClaimed:         atomic.LoadUint64(&c.bytesClaimed),
+		PacketsCopied:        atomic.LoadUint64(&c.packetsCopied),
+		BytesCopied:          atomic.LoadUint64(&c.bytesCopied),
+		PacketsRejected:      atomic.LoadUint64(&c.packetsRejected),
+		BytesRejected:        atomic.LoadUint64(&c.bytesRejected),
+		PacketsRateLimited:   atomic.LoadUint64(&c.packetsRateLimited),
+		BytesRateLimited:     atomic.LoadUint64(&c.bytesRateLimited),
+		PacketsDelivered:     atomic.LoadUint64(&c.packetsDelivered),
+		BytesDelivered:       atomic.LoadUint64(&c.bytesDelivered),
+		PacketsOverflowed:    atomic.LoadUint64(&c.packetsOverflowed),
+		BytesOverflowed:      atomic.LoadUint64(&c.bytesOverflowed),
+		PacketsByteLimited:   atomic.LoadUint64(&c.packetsByteLimited),
+		BytesByteLimited:     atomic.LoadUint64(&c.bytesByteLimited),
+		PacketsMemoryLimited: atomic.LoadUint64(&c.packetsMemoryLimited),
+		BytesMemoryLimited:   atomic.LoadUint64(&c.bytesMemoryLimited),
+		PacketsEvicted:       atomic.LoadUint64(&c.packetsEvicted),
+		BytesEvicted:         atomic.LoadUint64(&c.bytesEvicted),
+		Blocked:              atomic.LoadUint64(&c.blockedCount),
+		PacketsTimedOut:      atomic.LoadUint64(&c.packetsTimedOut),
+		BytesTimedOut:        atomic.LoadUint64(&c.bytesTimedOut),
+		PacketsWritten:       atomic.LoadUint64(&c.packetsWritten),
+		BytesWritten:         atomic.LoadUint64(&c.bytesWritten),
+	}
+	if last := atomic.LoadInt64(&c.lastActivity); last != 0 {
+		stats.LastActivity = time.Unix(0, last)
+	}
+	return stats
+}
+
+// add adds the counters of other to s, keeping the latest activity.
+func (s *ConnStats) add(other ConnStats) {
+	s.PacketsClaimed += other.PacketsClaimed
+	s.BytesClaimed += other.BytesClaimed
+	s.PacketsCopied += other.PacketsCopied
+	s.BytesCopied += other.BytesCopied
+	s.PacketsRejected += other.PacketsRejected
+	s.BytesRejected += other.BytesRejected
+	s.PacketsRateLimited += other.PacketsRateLimited
+	s.BytesRateLimited += other.BytesRateLimited
+	s.PacketsDelivered += other.PacketsDelivered
+	s.BytesDelivered += other.BytesDelivered
+	s.PacketsOverflowed += other.PacketsOverflowed
+	s.BytesOverflowed += other.BytesOverflowed
+	s.PacketsByteLimited += other.PacketsByteLimited
+	s.BytesByteLimited += other.BytesByteLimited
+	s.PacketsMemoryLimited += other.PacketsMemoryLimited
+	s.BytesMemoryLimited += other.BytesMemoryLimited
+	s.PacketsEvicted += other.PacketsEvicted
+	s.BytesEvicted += other.BytesEvicted
+	s.Blocked += other.Blocked
+	s.PacketsTimedOut += other.PacketsTimedOut
+	s.BytesTimedOut += other.BytesTimedOut
+	s.PacketsWritten += other.PacketsWritten
+	s.BytesWritten += other.BytesWritten
+	if other.LastActivity.After(s.LastActivity) {
+		s.LastActivity = other.LastActivity
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package pfilter
+
+// msgTrunc marks datagrams larger than the buffer. The platform has no such
+// flag, so truncation is only detected by reading one byte more than the
+// buffer size, and the value of MSG_TRUNC on Linux is used for the mark.
+const msgTrunc = 0x20
+
+// isMsgSizeError returns true if a read failed because the datagram was
+// larger than the buffer.
+func isMsgSizeError(error) bool {
+	return false
+}
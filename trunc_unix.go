@@ -0,0 +1,14 @@
+//go:build unix
+
+package pfilter
+
+import "syscall"
+
+// msgTrunc is the message flag reporting a datagram larger than the buffer.
+const msgTrunc = syscall.MSG_TRUNC
+
+// isMsgSizeError returns true if a read failed because the datagram was
+// larger than the buffer.
+func isMsgSizeError(error) bool {
+	return false
+}
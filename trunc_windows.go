@@ -0,0 +1,17 @@
+package pfilter
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// msgTrunc is the message flag reporting a datagram larger than the buffer.
+const msgTrunc = windows.MSG_TRUNC
+
+// isMsgSizeError returns true if a read failed because the datagram was
+// larger than the buffer, which Windows reports with WSAEMSGSIZE rather than
+// MSG_TRUNC. The buffer is filled with the start of the datagram regardless.
+func isMsgSizeError(err error) bool {
+	return errors.Is(err, windows.WSAEMSGSIZE)
+}
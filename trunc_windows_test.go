@@ -0,0 +1,61 @@
+package pfilter
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestMsgSizeError(t *testing.T) {
+	// As returned by net.UDPConn.ReadFrom.
+	err := &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("wsarecvfrom", windows.WSAEMSGSIZE)}
+	if !isMsgSizeError(err) {
+		t.Error("message size error not recognised")
+	}
+	if isMsgSizeError(&net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("wsarecvfrom", windows.WSAECONNRESET)}) {
+		t.Error("unrelated error recognised")
+	}
+}
+
+// oversizedConn returns a datagram larger than the buffer like Windows does.
+type oversizedConn struct {
+	net.PacketConn
+	reads int
+}
+
+func (c *oversizedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.reads++
+	if c.reads > 1 {
+		return c.PacketConn.ReadFrom(b)
+	}
+	n := copy(b, "0123456789")
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	return n, addr, &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("wsarecvfrom", windows.WSAEMSGSIZE)}
+}
+
+func TestMsgSizeErrorNotFatal(t *testing.T) {
+	server, _ := newTestPair(t)
+
+	pf, err := NewPacketFilterWithConfig(Config{
+		Conn:       &oversizedConn{PacketConn: server},
+		BufferSize: 5,
+		Backlog:    16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := pf.NewConn(1, nil)
+	pf.Start()
+	defer pf.Close()
+
+	buf := make([]byte, 10)
+	n, _, err := conn.ReadFrom(buf)
+	if err != errTruncated || string(buf[:n]) != "01234" {
+		t.Errorf("unexpected read %q, %v", buf[:n], err)
+	}
+	if pf.Err() != nil || pf.Truncated() != 1 {
+		t.Errorf("unexpected error %v, truncated %d", pf.Err(), pf.Truncated())
+	}
+}